@@ -12,16 +12,19 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 
 	"github.com/luisdavim/configmapper/pkg/config"
 	"github.com/luisdavim/configmapper/pkg/downloader"
 	"github.com/luisdavim/configmapper/pkg/filewatcher"
 	"github.com/luisdavim/configmapper/pkg/k8swatcher"
 	"github.com/luisdavim/configmapper/pkg/s3watcher"
+	"github.com/luisdavim/configmapper/pkg/utils"
 )
 
 func mustBindPFlag(key string, f *pflag.Flag) {
@@ -37,7 +40,7 @@ func New(cfg *config.Config) *cobra.Command {
 		Short: "Watch files, ConfigMaps and Secrets",
 		Long:  `Watch files, ConfigMaps and Secrets.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			fw, err := filewatcher.New(cfg.FileMap)
+			fw, err := filewatcher.New(cfg.FileMap, cfg.FileWatcher)
 			if err != nil {
 				return err
 			}
@@ -68,15 +71,23 @@ func New(cfg *config.Config) *cobra.Command {
 				}
 			}()
 			go func() {
-				if err := k8swatcher.Start(ctx, cfg.Watcher); err != nil {
+				if err := k8swatcher.Start(ctx, cfg.Watcher, map[string]healthz.Checker{"filewatcher": fw.Ready}); err != nil {
 					cmd.PrintErrf("failed to start k8s watcher: %v", err)
 					signals <- syscall.SIGABRT
 				}
 			}()
 			s := <-signals
-			dnlr.Stop()
-			s3.Stop()
+			// let the running downloads finish before canceling them
+			stopCtx, stopCancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+			if err := dnlr.Stop(stopCtx); err != nil {
+				cmd.PrintErrf("failed to stop the downloader: %v\n", err)
+			}
+			if err := s3.Stop(stopCtx); err != nil {
+				cmd.PrintErrf("failed to stop the S3 watcher: %v\n", err)
+			}
+			stopCancel()
 			cancel()
+			utils.StopRollouts()
 			if s == syscall.SIGABRT {
 				err = fmt.Errorf("aborted due to failures")
 			}
@@ -84,12 +95,27 @@ func New(cfg *config.Config) *cobra.Command {
 		},
 	}
 
+	cmd.Flags().StringP("file-watch-mode", "", "", "How to detect file changes: notify, poll or auto (defaults to notify)")
+	mustBindPFlag("fileWatcher.mode", cmd.Flags().Lookup("file-watch-mode"))
+
+	cmd.Flags().DurationP("poll-interval", "", 0, "How often to check for file changes when polling (defaults to 10s)")
+	mustBindPFlag("fileWatcher.pollInterval", cmd.Flags().Lookup("poll-interval"))
+
+	cmd.Flags().DurationP("shutdown-timeout", "", 25*time.Second, "How long to wait for the running downloads to finish when stopping")
+	mustBindPFlag("shutdownTimeout", cmd.Flags().Lookup("shutdown-timeout"))
+
 	cmd.Flags().BoolP("watch-configmaps", "", false, "Whether to watch ConfigMaps")
 	mustBindPFlag("watcher.configMaps", cmd.Flags().Lookup("watch-configmaps"))
 
 	cmd.Flags().BoolP("watch-secrets", "", false, "Whether to watch secrets")
 	mustBindPFlag("watcher.secrets", cmd.Flags().Lookup("watch-secrets"))
 
+	cmd.Flags().StringP("metrics-bind-address", "", ":8080", "The address the metrics are served on, set to an empty string to disable them, only used by default when watching ConfigMaps or Secrets")
+	mustBindPFlag("watcher.metricsAddr", cmd.Flags().Lookup("metrics-bind-address"))
+
+	cmd.Flags().StringP("health-probe-bind-address", "", ":8081", "The address the health probes are served on, set to an empty string to disable them, only used by default when watching ConfigMaps or Secrets")
+	mustBindPFlag("watcher.probeAddr", cmd.Flags().Lookup("health-probe-bind-address"))
+
 	cmd.Flags().StringP("default-path", "p", "/tmp", "Default path where to write the files")
 	mustBindPFlag("watcher.defaultPath", cmd.Flags().Lookup("default-path"))
 
@@ -166,6 +192,16 @@ func initConfig(cfgFile string) (config.Config, error) {
 		log.Println("Using config file:", viper.ConfigFileUsed())
 		err = viper.Unmarshal(&cfg, config.DecodeHooks())
 	}
+	if err == nil && !cfg.Watcher.ConfigMaps && !cfg.Watcher.Secrets {
+		// without ConfigMaps or Secrets to watch, the probes and metrics are only served on the addresses set explicitly,
+		// so a sidecar that only maps files, URLs or buckets doesn't take ports the app may be using
+		if !viper.IsSet("watcher.metricsAddr") {
+			cfg.Watcher.MetricsAddr = ""
+		}
+		if !viper.IsSet("watcher.probeAddr") {
+			cfg.Watcher.ProbeAddr = ""
+		}
+	}
 
 	return cfg, err
 }
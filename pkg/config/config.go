@@ -10,7 +10,11 @@ type Config struct {
 	URLMap  URLMap  `mapstructure:"urlMap,omitempty"`
 	S3Map   S3Map   `mapstructure:"s3Map,omitempty"`
 	FileMap FileMap `mapstructure:"fileMap,omitempty"`
-	Watcher Watcher `mapstructure:"watcher,omitempty"`
+	// FileWatcher sets the default WatchMode for all the entries in the FileMap
+	FileWatcher WatchMode `mapstructure:"fileWatcher,omitempty"`
+	Watcher     Watcher   `mapstructure:"watcher,omitempty"`
+	// ShutdownTimeout is how long to wait for the running downloads to finish when stopping
+	ShutdownTimeout metav1.Duration `mapstructure:"shutdownTimeout,omitempty"`
 }
 
 type SignalMap map[string]SignalMapping
@@ -31,6 +35,48 @@ type FileMapping struct {
 	SignalMapping `mapstructure:",squash"`
 	// URL where to post the data from the watched file
 	URL string `mapstructure:"url,omitempty"`
+	// Recursive includes the files in subdirectories when the path is a directory
+	Recursive bool `mapstructure:"recursive,omitempty"`
+	// Include only maps the files matching any of these patterns
+	Include []string `mapstructure:"include,omitempty"`
+	// Exclude skips the files matching any of these patterns
+	Exclude []string `mapstructure:"exclude,omitempty"`
+	// InitialSync controls how the file is handled when the watcher starts
+	InitialSync InitialSync `mapstructure:"initialSync,omitempty"`
+	// Debounce coalesces bursts of filesystem events into a single update
+	Debounce Debounce `mapstructure:"debounce,omitempty"`
+	// WatchMode configures how changes to the file are detected
+	WatchMode `mapstructure:",squash"`
+	// OnDelete is what happens to the mapped resource when the path is deleted: keep (the default), removeKey or delete
+	// files removed from a mapped directory are always removed from the resource
+	OnDelete string `mapstructure:"onDelete,omitempty"`
+	// Timeout bounds each run of the mapping, including posting to the URL, defaults to 30s
+	Timeout metav1.Duration `mapstructure:"timeout,omitempty"`
+}
+
+// WatchMode configures how file changes are detected
+type WatchMode struct {
+	// Mode is one of notify (the default), poll or auto,
+	// auto uses notify unless the file is on a network filesystem or the watch can't be established
+	Mode string `mapstructure:"mode,omitempty"`
+	// PollInterval is how often the files are checked for changes when polling
+	PollInterval metav1.Duration `mapstructure:"pollInterval,omitempty"`
+}
+
+// Debounce configures how filesystem events are coalesced
+type Debounce struct {
+	// QuietPeriod is how long to wait, after the last event, before running the mapping
+	QuietPeriod metav1.Duration `mapstructure:"quietPeriod,omitempty"`
+	// MaxWait is the longest time the mapping can be delayed by a continuous burst of events
+	MaxWait metav1.Duration `mapstructure:"maxWait,omitempty"`
+}
+
+// InitialSync configures the reconciliation pass that runs for each FileMapping before watching for changes
+type InitialSync struct {
+	// Disabled skips the startup reconciliation, the mapping only runs on file changes
+	Disabled bool `mapstructure:"disabled,omitempty"`
+	// Signal sends the configured signal to the process during the startup reconciliation
+	Signal bool `mapstructure:"signal,omitempty"`
 }
 
 type S3Map map[string]S3Mapping
@@ -38,11 +84,100 @@ type S3Map map[string]S3Mapping
 type S3Mapping struct {
 	BucketName string `mapstructure:"bucketName,omitempty"`
 	S3Endpoint string `mapstructure:"s3Endpoint,omitempty"`
+	// Region of the bucket, defaults to the AWS_REGION environment variable
+	Region string `mapstructure:"region,omitempty"`
+	// PathStyle addresses the bucket in the URL path instead of the host name, as needed by MinIO and Ceph
+	PathStyle bool `mapstructure:"pathStyle,omitempty"`
+	// CAFile is a PEM bundle with the CAs used to verify the endpoint, instead of the system ones
+	CAFile string `mapstructure:"caFile,omitempty"`
+	// Credentials are static credentials used instead of the ones found in the environment
+	Credentials S3Credentials `mapstructure:"credentials,omitempty"`
+	// AssumeRole assumes an IAM role with the credentials
+	AssumeRole AssumeRole `mapstructure:"assumeRole,omitempty"`
 	// ResourceMapping can map a file in a bucket to a Kubernetes Secret or ConfigMap
 	// when the file changes the Kubernetes resource is updated with the file contents
 	ResourceMapping `mapstructure:",squash"`
+	// LocalMapping can mirror the files in a bucket to a local directory
+	LocalMapping `mapstructure:",squash"`
 	// Interval defines how often to poll the URL
 	Interval metav1.Duration `mapstructure:"interval"`
+	// Timeout bounds each poll of the bucket, defaults to 5m
+	Timeout metav1.Duration `mapstructure:"timeout,omitempty"`
+	// Schedule configures when the bucket is polled
+	Schedule Schedule `mapstructure:"schedule,omitempty"`
+	// Concurrency is how many objects are downloaded at the same time, defaults to 4
+	Concurrency int `mapstructure:"concurrency,omitempty"`
+	// MaxObjects is the maximum number of objects under the prefix, there's no limit by default
+	MaxObjects int `mapstructure:"maxObjects,omitempty"`
+	// MaxSize is the maximum total size of the objects under the prefix in bytes,
+	// defaults to 1MiB, the size limit of a ConfigMap or Secret, when mapping to a resource
+	MaxSize int64 `mapstructure:"maxSize,omitempty"`
+	// Match is prefix (the default), to map all the objects under the prefix,
+	// or exact, to only map the object with this key, stored under the mapping's Key, defaulting to its base name
+	Match string `mapstructure:"match,omitempty"`
+	// KeyNaming is how the objects under the prefix are named in the resource:
+	// path (the default) encodes their path relative to the prefix, replacing the separators with __,
+	// base uses their base name and template renders the KeyTemplate
+	KeyNaming string `mapstructure:"keyNaming,omitempty"`
+	// KeyTemplate names the objects when using the template KeyNaming,
+	// it can use {{.Key}}, the object key, {{.Path}}, its path relative to the prefix, and {{.Base}}, its base name
+	KeyTemplate string `mapstructure:"keyTemplate,omitempty"`
+	// Include only maps the objects whose keys end with any of these suffixes
+	Include []string `mapstructure:"include,omitempty"`
+	// Exclude skips the objects whose keys end with any of these suffixes
+	Exclude []string `mapstructure:"exclude,omitempty"`
+}
+
+// S3Credentials are static S3 credentials read from files or Secrets, they are read again every few minutes
+type S3Credentials struct {
+	AccessKeyID     ValueFrom `mapstructure:"accessKeyID,omitempty"`
+	SecretAccessKey ValueFrom `mapstructure:"secretAccessKey,omitempty"`
+	SessionToken    ValueFrom `mapstructure:"sessionToken,omitempty"`
+}
+
+// AssumeRole configures the role assumed through STS
+type AssumeRole struct {
+	// RoleARN is the ARN of the role to assume
+	RoleARN string `mapstructure:"roleARN,omitempty"`
+	// ExternalID is the external ID required by the role's trust policy
+	ExternalID string `mapstructure:"externalID,omitempty"`
+	// SessionName defaults to configmapper
+	SessionName string `mapstructure:"sessionName,omitempty"`
+	// STSEndpoint is the STS endpoint, defaults to the regional AWS one
+	STSEndpoint string `mapstructure:"stsEndpoint,omitempty"`
+}
+
+// LocalMapping writes data to files in a local directory, instead of, or as well as, a Kubernetes resource
+type LocalMapping struct {
+	// Path is the directory where each key is written as a file,
+	// files are replaced atomically and only when their content changes
+	Path string `mapstructure:"path,omitempty"`
+	// FileMode is the octal mode of the files, like "0640",
+	// defaults to 0600 when the data is also mapped to a Secret and to 0644 otherwise
+	FileMode string `mapstructure:"fileMode,omitempty"`
+	// SignalMapping can map the files to a process, when a file changes the process is sent the specified signal
+	SignalMapping `mapstructure:",squash"`
+}
+
+// Schedule configures when a source is polled, on top of its Interval
+type Schedule struct {
+	// Cron is a cron expression, like "*/5 * * * *" or "@hourly", the source is polled on it instead of the Interval
+	Cron string `mapstructure:"cron,omitempty"`
+	// Jitter delays each poll by a random duration up to this value, so replicas don't poll at the same time
+	Jitter metav1.Duration `mapstructure:"jitter,omitempty"`
+	// Backoff delays the polls after consecutive failures
+	Backoff Backoff `mapstructure:"backoff,omitempty"`
+	// MinInterval is the minimum time between the end of a poll and the start of the next one
+	MinInterval metav1.Duration `mapstructure:"minInterval,omitempty"`
+}
+
+// Backoff configures the exponential backoff after consecutive failures
+type Backoff struct {
+	// Initial is the delay after the first failure, it doubles after each consecutive failure,
+	// the backoff is disabled when it's not set
+	Initial metav1.Duration `mapstructure:"initial,omitempty"`
+	// Max is the longest delay, defaults to 10m
+	Max metav1.Duration `mapstructure:"max,omitempty"`
 }
 
 type ResourceMap map[string]ResourceMapping
@@ -52,6 +187,40 @@ type ResourceMapping struct {
 	Namespace    string `mapstructure:"namespace,omitempty"`
 	Name         string `mapstructure:"name,omitempty"`
 	Key          string `mapstructure:"key,omitempty"`
+	// Strategy is how the data is written to the resource: replace (the default) overwrites all its keys,
+	// merge only updates the keys written by this mapping so several mappings can share the same resource
+	// and apply uses server-side apply, the keys are owned by the mapping's field manager
+	Strategy string `mapstructure:"strategy,omitempty"`
+	// FieldManager is the field manager used with the apply strategy,
+	// defaults to configmapper/<hash>, derived from the mapping, so each mapping has its own
+	FieldManager string `mapstructure:"fieldManager,omitempty"`
+	// Force takes ownership of the keys managed by other field managers when using the apply strategy
+	Force bool `mapstructure:"force,omitempty"`
+	// Labels are added to the resource, the values are templates that can use {{.Name}} and {{.Namespace}}
+	// and must render to valid label values
+	Labels map[string]string `mapstructure:"labels,omitempty"`
+	// Annotations are added to the resource, the values are templates that can use
+	// {{.Source}}, {{.Hash}}, {{.Name}} and {{.Namespace}}
+	Annotations map[string]string `mapstructure:"annotations,omitempty"`
+	// OwnerReference sets the sidecar's pod or its workload as the owner of the resource,
+	// so it's garbage collected with the app, one of pod or workload
+	OwnerReference string `mapstructure:"ownerReference,omitempty"`
+	// Immutable publishes the data in immutable resources named <name>-<hash>,
+	// the resource named <name> points to the current revision
+	Immutable bool `mapstructure:"immutable,omitempty"`
+	// Revisions is how many immutable revisions are kept, defaults to 5
+	Revisions int `mapstructure:"revisions,omitempty"`
+	// Rollout restarts the workloads using the resource when it changes
+	Rollout Rollout `mapstructure:"rollout,omitempty"`
+}
+
+// Rollout configures how the workloads using a resource are restarted when it changes
+type Rollout struct {
+	// Enabled restarts the Deployments, StatefulSets and DaemonSets that reference the resource
+	// in their volumes, envFrom or env, or list it in the configmapper/rollout-on annotation
+	Enabled bool `mapstructure:"enabled,omitempty"`
+	// MinInterval is the minimum time between two restarts of the same workload, defaults to 10s
+	MinInterval metav1.Duration `mapstructure:"minInterval,omitempty"`
 }
 
 type URLMap map[string]URLMapping
@@ -61,8 +230,107 @@ type URLMapping struct {
 	// ResourceMapping can map a URL to a Kubernetes Secret or ConfigMap
 	// The Kubernetes resource is updated with the data fetched from the URL
 	ResourceMapping `mapstructure:",squash"`
+	// LocalMapping can write the data fetched from the URL to a local file, named after the Key
+	LocalMapping `mapstructure:",squash"`
 	// Interval defines how often to poll the URL
 	Interval metav1.Duration `mapstructure:"interval"`
+	// Timeout bounds each poll of the URL, including the retries and updating the resource, defaults to 1m
+	Timeout metav1.Duration `mapstructure:"timeout,omitempty"`
+	// Schedule configures when the URL is polled
+	Schedule Schedule `mapstructure:"schedule,omitempty"`
+	// Validation defines the checks a response must pass to be stored
+	Validation Validation `mapstructure:"validation,omitempty"`
+	// Request configures the HTTP request made to poll the URL
+	Request Request `mapstructure:"request,omitempty"`
+	// Extract selects the data to store from a JSON or YAML response
+	Extract Extract `mapstructure:"extract,omitempty"`
+}
+
+// Extract selects the data to store from a JSON or YAML document
+type Extract struct {
+	// Path is a JSONPath expression, like {.data} or .data.config, selecting the sub-document to store
+	Path string `mapstructure:"path,omitempty"`
+	// FanOut stores each top-level field of the selected object under its own key, instead of using the mapping's Key
+	FanOut bool `mapstructure:"fanOut,omitempty"`
+	// Format re-encodes the selected values as json or yaml, defaults to json,
+	// string values are always stored as they are
+	Format string `mapstructure:"format,omitempty"`
+}
+
+// Request configures an HTTP request and the client making it
+type Request struct {
+	// Method is the HTTP method, defaults to GET
+	Method string `mapstructure:"method,omitempty"`
+	// Body is sent with the request
+	Body string `mapstructure:"body,omitempty"`
+	// Headers are added to the request
+	Headers map[string]string `mapstructure:"headers,omitempty"`
+	// Auth sets the request credentials
+	Auth Auth `mapstructure:"auth,omitempty"`
+	// TLS configures the client certificate and the CA bundle used to verify the server
+	TLS TLS `mapstructure:"tls,omitempty"`
+	// Proxy is the URL of the proxy to use, defaults to the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+	Proxy string `mapstructure:"proxy,omitempty"`
+	// Timeout is the time limit for each attempt
+	Timeout metav1.Duration `mapstructure:"timeout,omitempty"`
+	// Retry configures how failed requests are retried
+	Retry Retry `mapstructure:"retry,omitempty"`
+}
+
+// Auth sets a bearer token or basic auth credentials on a request
+type Auth struct {
+	// BearerToken is sent in the Authorization header
+	BearerToken ValueFrom `mapstructure:"bearerToken,omitempty"`
+	// Username and Password are sent as basic auth credentials
+	Username string    `mapstructure:"username,omitempty"`
+	Password ValueFrom `mapstructure:"password,omitempty"`
+}
+
+// ValueFrom reads a value from a file or from a key in a Secret,
+// it's read every time it's used so rotated credentials are picked up
+type ValueFrom struct {
+	File   string       `mapstructure:"file,omitempty"`
+	Secret SecretKeyRef `mapstructure:"secret,omitempty"`
+}
+
+// SecretKeyRef selects a key in a Secret, the namespace defaults to the Pod's namespace
+type SecretKeyRef struct {
+	Name      string `mapstructure:"name,omitempty"`
+	Namespace string `mapstructure:"namespace,omitempty"`
+	Key       string `mapstructure:"key,omitempty"`
+}
+
+// TLS configures the TLS client
+type TLS struct {
+	// CAFile is a PEM bundle with the CAs used to verify the server, instead of the system ones
+	CAFile string `mapstructure:"caFile,omitempty"`
+	// CertFile and KeyFile are the PEM encoded client certificate and key, for mTLS
+	CertFile string `mapstructure:"certFile,omitempty"`
+	KeyFile  string `mapstructure:"keyFile,omitempty"`
+	// InsecureSkipVerify disables the server certificate verification
+	InsecureSkipVerify bool `mapstructure:"insecureSkipVerify,omitempty"`
+}
+
+// Retry configures the retries of failed requests
+type Retry struct {
+	// Max is the maximum number of retries, defaults to 4, set to -1 to disable retries
+	Max int `mapstructure:"max,omitempty"`
+	// WaitMin and WaitMax bound the exponential backoff between retries
+	WaitMin metav1.Duration `mapstructure:"waitMin,omitempty"`
+	WaitMax metav1.Duration `mapstructure:"waitMax,omitempty"`
+}
+
+// Validation defines the checks a response must pass to be stored,
+// when a check fails, the last good content is kept
+type Validation struct {
+	// AcceptedStatuses are the response status codes that are stored, defaults to any 2xx status
+	AcceptedStatuses []int `mapstructure:"acceptedStatuses,omitempty"`
+	// ContentType is the expected media type of the response, like application/json
+	ContentType string `mapstructure:"contentType,omitempty"`
+	// MaxSize is the maximum size of the response body in bytes
+	MaxSize int64 `mapstructure:"maxSize,omitempty"`
+	// Format checks that the response body parses as json or yaml
+	Format string `mapstructure:"format,omitempty"`
 }
 
 type Watcher struct {
@@ -73,5 +341,11 @@ type Watcher struct {
 	LabelSelector string          `mapstructure:"labelSelector,omitempty"`
 	DefaultPath   string          `mapstructure:"defaultPath,omitempty"`
 	Interval      metav1.Duration `mapstructure:"interval,omitempty"`
+	// MetricsAddr is the address the metrics are served on, an empty address disables the metrics server,
+	// defaults to :8080 when watching ConfigMaps or Secrets, otherwise it's only served when set
+	MetricsAddr string `mapstructure:"metricsAddr,omitempty"`
+	// ProbeAddr is the address the health probes are served on, an empty address disables the probes,
+	// defaults to :8081 when watching ConfigMaps or Secrets, otherwise they're only served when set
+	ProbeAddr     string `mapstructure:"probeAddr,omitempty"`
 	SignalMapping `mapstructure:",squash"`
 }
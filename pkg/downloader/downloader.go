@@ -2,18 +2,28 @@ package downloader
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"mime"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
 	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	konfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/yaml"
 
 	"github.com/luisdavim/configmapper/pkg/config"
 	"github.com/luisdavim/configmapper/pkg/utils"
@@ -22,14 +32,35 @@ import (
 const (
 	DefaultKey      = "config"
 	DefaultInterval = time.Minute
+	// DefaultTimeout bounds each poll of a URL
+	DefaultTimeout = time.Minute
+
+	// FormatJSON and FormatYAML are the formats a response can be validated against
+	FormatJSON = "json"
+	FormatYAML = "yaml"
 )
 
+// cache holds the validators and the server's polling hints for a URL
+type cache struct {
+	etag         string
+	lastModified string
+	// wait is how long the server asked to wait before the next request,
+	// from the Cache-Control max-age or the Retry-After headers
+	wait time.Duration
+	// files are the keys last written to the mapping's path
+	files []string
+}
+
 type Downloader struct {
 	config config.URLMap
 	log    zerolog.Logger
 	stop   map[string](chan struct{})
-	client *retryablehttp.Client
-	k8s    client.Client
+	// clients holds the HTTP client for each URL
+	clients map[string]*retryablehttp.Client
+	k8s     client.Client
+	cache   map[string]cache
+	// running tracks the polling goroutines so Stop can wait for them
+	running sync.WaitGroup
 	sync.RWMutex
 }
 
@@ -44,17 +75,18 @@ func New(cfg config.URLMap) (*Downloader, error) {
 	}
 
 	d := &Downloader{
-		config: cfg,
-		client: retryablehttp.NewClient(),
-		k8s:    c,
-		stop:   make(map[string](chan struct{})),
-		log:    zerolog.New(os.Stderr).With().Timestamp().Str("name", "downloader").Logger().Level(zerolog.InfoLevel),
+		config:  cfg,
+		clients: make(map[string]*retryablehttp.Client),
+		k8s:     c,
+		cache:   make(map[string]cache),
+		stop:    make(map[string](chan struct{})),
+		log:     zerolog.New(os.Stderr).With().Timestamp().Str("name", "downloader").Logger().Level(zerolog.InfoLevel),
 	}
 
 	curNS, _ := utils.GetInClusterNamespace()
 	for u, c := range cfg {
-		if c.Name == "" {
-			return nil, fmt.Errorf("no resource name for %s", u)
+		if c.Name == "" && c.Path == "" {
+			return nil, fmt.Errorf("no resource name or path for %s", u)
 		}
 		if c.Namespace == "" {
 			c.Namespace = curNS
@@ -79,6 +111,32 @@ func New(cfg config.URLMap) (*Downloader, error) {
 			c.Interval.Duration = DefaultInterval
 			d.config[u] = c
 		}
+		if c.Timeout.Duration == 0 {
+			c.Timeout.Duration = DefaultTimeout
+			d.config[u] = c
+		}
+		if c.Strategy == "" {
+			c.Strategy = utils.StrategyReplace
+			d.config[u] = c
+		}
+		if err := utils.ValidateResource(c.ResourceMapping); err != nil {
+			return nil, fmt.Errorf("invalid resource mapping for %s: %w", u, err)
+		}
+		if _, err := utils.FileMode(c.LocalMapping, c.ResourceType); err != nil {
+			return nil, fmt.Errorf("invalid local mapping for %s: %w", u, err)
+		}
+		if !supportedFormat(c.Validation.Format) {
+			return nil, fmt.Errorf("invalid validation for %s: unknown format %s", u, c.Validation.Format)
+		}
+		if err := validateExtract(c.Extract); err != nil {
+			return nil, fmt.Errorf("invalid extract for %s: %w", u, err)
+		}
+		if _, err := utils.NewSchedule(c.Interval.Duration, c.Schedule); err != nil {
+			return nil, fmt.Errorf("invalid schedule for %s: %w", u, err)
+		}
+		if d.clients[u], err = newClient(c.Request); err != nil {
+			return nil, fmt.Errorf("invalid request for %s: %w", u, err)
+		}
 	}
 
 	return d, nil
@@ -87,6 +145,7 @@ func New(cfg config.URLMap) (*Downloader, error) {
 func (d *Downloader) Start(ctx context.Context) {
 	d.Lock()
 	defer d.Unlock()
+	d.prune(ctx)
 	for url := range d.config {
 		if _, ok := d.stop[url]; ok {
 			// already running
@@ -97,30 +156,51 @@ func (d *Downloader) Start(ctx context.Context) {
 	}
 }
 
-func (d *Downloader) Stop() {
+// Stop stops polling the URLs and waits for the running downloads to finish,
+// it gives up waiting when ctx is done
+func (d *Downloader) Stop(ctx context.Context) error {
 	d.Lock()
-	defer d.Unlock()
 	for url := range d.config {
 		if stopCh, ok := d.stop[url]; ok && stopCh != nil {
 			close(stopCh)
 		}
 		delete(d.stop, url)
 	}
+	d.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for the downloads to finish: %w", ctx.Err())
+	}
 }
 
 func (d *Downloader) schedule(ctx context.Context, url string) {
 	d.log.Info().Str("url", url).Msg("starting")
 	stopCh := d.stop[url]
+	cfg := d.config[url]
+	sched, err := utils.NewSchedule(cfg.Interval.Duration, cfg.Schedule)
+	if err != nil {
+		d.log.Err(err).Str("url", url).Msg("invalid schedule")
+		return
+	}
+	d.running.Add(1)
 	go func() {
-		err := d.download(ctx, url)
-		d.log.Err(err).Str("url", url).Msgf("downloading")
-		ticker := time.NewTicker(d.config[url].Interval.Duration)
-		defer ticker.Stop()
+		defer d.running.Done()
+		timer := time.NewTimer(sched.First())
+		defer timer.Stop()
 		for {
 			select {
-			case <-ticker.C:
+			case <-timer.C:
 				err := d.download(ctx, url)
 				d.log.Err(err).Str("url", url).Msgf("downloading")
+				timer.Reset(d.next(url, sched, err))
 			case <-ctx.Done():
 				d.log.Info().Str("url", url).Msg("context canceled, stopping")
 				return
@@ -139,32 +219,234 @@ func (d *Downloader) download(ctx context.Context, url string) error {
 	if !ok {
 		return fmt.Errorf("config for %s not found", url)
 	}
+	if cfg.Timeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout.Duration)
+		defer cancel()
+	}
 
-	body, err := d.get(url)
+	d.RLock()
+	cached := d.cache[url]
+	d.RUnlock()
+
+	body, res, err := d.get(ctx, url, cfg, cached)
+	if res != nil {
+		cached.wait = pollHint(res.Header, time.Now())
+		d.Lock()
+		d.cache[url] = cached
+		d.Unlock()
+	}
+	var invalid *invalidResponseError
+	if errors.As(err, &invalid) {
+		return d.reject(ctx, url, cfg, invalid)
+	}
 	if err != nil {
 		return err
 	}
+	if res.StatusCode == http.StatusNotModified {
+		d.log.Debug().Str("url", url).Msg("not modified")
+		return nil
+	}
+
+	data, err := extract(body, cfg.Key, cfg.Extract)
+	if err != nil {
+		return d.reject(ctx, url, cfg, &invalidResponseError{reason: "extract", err: err})
+	}
+
+	if cfg.Name != "" {
+		op, err := utils.CreateOrUpdate(ctx, cfg.ResourceMapping, owner(url), data, d.k8s)
+		d.log.Err(err).Str("operation", string(op)).Msgf("%s: %s/%s", cfg.ResourceType, cfg.Namespace, cfg.Name)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Path != "" {
+		// the mode was validated with the mapping
+		mode, _ := utils.FileMode(cfg.LocalMapping, cfg.ResourceType)
+		changed, err := utils.MirrorFiles(ctx, cfg.LocalMapping, mode, cached.files, data)
+		d.log.Err(err).Str("url", url).Str("operation", "write").Msgf("%s: %d files changed", cfg.Path, len(changed))
+		if err != nil {
+			return err
+		}
+		cached.files = slices.Collect(maps.Keys(data))
+	}
+
+	// only keep the validators once the content was stored,
+	// otherwise a failed update would never be retried
+	cached.etag = res.Header.Get("ETag")
+	cached.lastModified = res.Header.Get("Last-Modified")
+	d.Lock()
+	d.cache[url] = cached
+	d.Unlock()
+	return nil
+}
+
+// reject records an invalid response from url, the last good content is kept
+func (d *Downloader) reject(ctx context.Context, url string, cfg config.URLMapping, invalid *invalidResponseError) error {
+	rejections.WithLabelValues(url, invalid.reason).Inc()
+	if cfg.Name != "" {
+		msg := fmt.Sprintf("rejected the response from %s: %v", url, invalid)
+		eventErr := utils.RecordResourceEvent(ctx, d.k8s, cfg.ResourceMapping, corev1.EventTypeWarning, "InvalidResponse", msg)
+		d.log.Err(eventErr).Str("url", url).Str("reason", invalid.reason).Msg("recording event")
+	}
+	return fmt.Errorf("invalid response: %w", invalid)
+}
+
+// next returns how long to wait before polling url again, after a download that returned err,
+// it's never shorter than the server's polling hints
+func (d *Downloader) next(url string, sched *utils.Schedule, err error) time.Duration {
+	d.RLock()
+	wait := d.cache[url].wait
+	d.RUnlock()
+	return sched.Next(time.Now(), err, wait)
+}
+
+// pollHint returns how long the server asked to wait before the next request
+func pollHint(h http.Header, now time.Time) time.Duration {
+	var wait time.Duration
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(directive), "max-age="); ok {
+			if age, err := strconv.Atoi(strings.Trim(v, `"`)); err == nil && age > 0 {
+				wait = time.Duration(age) * time.Second
+			}
+		}
+	}
+	if age, err := strconv.Atoi(h.Get("Age")); err == nil && age > 0 {
+		wait = max(wait-time.Duration(age)*time.Second, 0)
+	}
 
-	data := map[string]string{
-		cfg.Key: body,
+	if v := h.Get("Retry-After"); v != "" {
+		if s, err := strconv.Atoi(v); err == nil && s > 0 {
+			wait = max(wait, time.Duration(s)*time.Second)
+		} else if t, err := http.ParseTime(v); err == nil {
+			wait = max(wait, t.Sub(now))
+		}
 	}
+	return wait
+}
 
-	op, err := utils.CreateOrUpdate(ctx, cfg.Name, cfg.Namespace, cfg.ResourceType, data, d.k8s)
-	d.log.Err(err).Str("operation", string(op)).Msgf("%s: %s/%s", cfg.ResourceType, cfg.Namespace, cfg.Name)
-	return err
+// owner returns the identifier of the mapping for url in the resources it merges into
+func owner(url string) string {
+	return utils.Owner("url", url)
+}
+
+// prune removes the keys written by URL mappings that are no longer configured
+func (d *Downloader) prune(ctx context.Context) {
+	mappings := make(map[string]config.ResourceMapping, len(d.config))
+	for url, cfg := range d.config {
+		mappings[owner(url)] = cfg.ResourceMapping
+	}
+	err := utils.Prune(ctx, utils.Owner("url", ""), mappings, d.k8s)
+	d.log.Err(err).Str("operation", "prune").Msg("removing keys of deleted mappings")
 }
 
-func (d *Downloader) get(url string) (string, error) {
-	res, err := d.client.Get(url)
+// get downloads url, the request is conditional when there are cached validators for it
+// and the response is checked against the mapping's validation
+func (d *Downloader) get(ctx context.Context, url string, cfg config.URLMapping, cached cache) ([]byte, *http.Response, error) {
+	req, err := d.newRequest(ctx, url, cfg.Request, cfg.Namespace)
 	if err != nil {
-		return "", err
+		return nil, nil, err
+	}
+	v := cfg.Validation
+	if cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	if cached.lastModified != "" {
+		req.Header.Set("If-Modified-Since", cached.lastModified)
 	}
 
-	body, err := io.ReadAll(res.Body)
+	d.RLock()
+	httpClient := d.clients[url]
+	d.RUnlock()
+	res, err := httpClient.Do(req)
 	if err != nil {
-		return "", err
+		if res != nil {
+			_ = res.Body.Close()
+		}
+		return nil, res, err
 	}
-	_ = res.Body.Close()
+	defer func() { _ = res.Body.Close() }()
 
-	return string(body), nil
+	if res.StatusCode == http.StatusNotModified {
+		return nil, res, nil
+	}
+	if !accepted(v.AcceptedStatuses, res.StatusCode) {
+		return nil, res, &invalidResponseError{reason: "status", err: fmt.Errorf("unexpected status: %s", res.Status)}
+	}
+	if v.ContentType != "" {
+		mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		if err != nil || !strings.EqualFold(mediaType, v.ContentType) {
+			return nil, res, &invalidResponseError{reason: "contentType", err: fmt.Errorf("unexpected content type %q, want %s", res.Header.Get("Content-Type"), v.ContentType)}
+		}
+	}
+
+	var r io.Reader = res.Body
+	if v.MaxSize > 0 {
+		r = io.LimitReader(res.Body, v.MaxSize+1)
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, res, err
+	}
+	if v.MaxSize > 0 && int64(len(body)) > v.MaxSize {
+		return nil, res, &invalidResponseError{reason: "size", err: fmt.Errorf("response larger than %d bytes", v.MaxSize)}
+	}
+	if err := validateFormat(v.Format, body); err != nil {
+		return nil, res, &invalidResponseError{reason: "format", err: err}
+	}
+
+	return body, res, nil
+}
+
+// invalidResponseError is returned for responses that fail validation
+type invalidResponseError struct {
+	// reason is the check that failed
+	reason string
+	err    error
+}
+
+func (e *invalidResponseError) Error() string {
+	return e.err.Error()
+}
+
+func (e *invalidResponseError) Unwrap() error {
+	return e.err
+}
+
+// accepted reports whether the status code is one of the accepted ones, any 2xx status by default
+func accepted(statuses []int, code int) bool {
+	if len(statuses) == 0 {
+		return code >= 200 && code < 300
+	}
+	return slices.Contains(statuses, code)
+}
+
+// supportedFormat reports whether format is empty or one of the formats responses can be validated against
+func supportedFormat(format string) bool {
+	switch format {
+	case "", FormatJSON, FormatYAML:
+		return true
+	default:
+		return false
+	}
+}
+
+func validateFormat(format string, body []byte) error {
+	switch format {
+	case "":
+		return nil
+	case FormatJSON:
+		if !json.Valid(body) {
+			return fmt.Errorf("response is not valid JSON")
+		}
+		return nil
+	case FormatYAML:
+		var v any
+		if err := yaml.Unmarshal(body, &v); err != nil {
+			return fmt.Errorf("response is not valid YAML: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown format %s", format)
+	}
 }
@@ -0,0 +1,291 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+	"github.com/luisdavim/configmapper/pkg/utils"
+)
+
+func newTestDownloader(t *testing.T, cfg config.URLMap, objs ...client.Object) *Downloader {
+	t.Helper()
+
+	d := &Downloader{
+		config:  cfg,
+		clients: make(map[string]*retryablehttp.Client),
+		k8s:     fake.NewClientBuilder().WithObjects(objs...).Build(),
+		cache:   make(map[string]cache),
+		stop:    make(map[string](chan struct{})),
+		log:     zerolog.New(os.Stderr).Level(zerolog.Disabled),
+	}
+	for u, c := range cfg {
+		if c.Request.Retry.Max == 0 {
+			c.Request.Retry.Max = -1
+		}
+		httpClient, err := newClient(c.Request)
+		if err != nil {
+			t.Fatalf("newClient() error = %v", err)
+		}
+		httpClient.Logger = nil
+		d.clients[u] = httpClient
+	}
+	return d
+}
+
+func TestDownloadSkipsNotModified(t *testing.T) {
+	t.Parallel()
+
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "public, max-age=120")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("a: b"))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	res := config.ResourceMapping{ResourceType: "configmap", Namespace: "default", Name: "app", Key: "config"}
+	d := newTestDownloader(t, config.URLMap{srv.URL: {ResourceMapping: res, Interval: metav1.Duration{Duration: time.Minute}}})
+
+	if err := d.download(ctx, srv.URL); err != nil {
+		t.Fatalf("download() error = %v", err)
+	}
+
+	// changes made to the ConfigMap are kept while the URL is not modified
+	cm := &corev1.ConfigMap{}
+	key := client.ObjectKey{Name: "app", Namespace: "default"}
+	if err := d.k8s.Get(ctx, key, cm); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	cm.Data["config"] = "changed"
+	if err := d.k8s.Update(ctx, cm); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	if err := d.download(ctx, srv.URL); err != nil {
+		t.Fatalf("download() error = %v", err)
+	}
+	if err := d.k8s.Get(ctx, key, cm); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if requests != 2 || cm.Data["config"] != "changed" {
+		t.Fatalf("got %d requests and config = %q, want 2 requests and the ConfigMap left untouched", requests, cm.Data["config"])
+	}
+
+	sched, err := utils.NewSchedule(time.Minute, config.Schedule{})
+	if err != nil {
+		t.Fatalf("NewSchedule() error = %v", err)
+	}
+	if got := d.next(srv.URL, sched, nil); got != 2*time.Minute {
+		t.Fatalf("next() = %s, want the max-age", got)
+	}
+}
+
+func TestPollHint(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{name: "no hints", header: http.Header{}, want: 0},
+		{name: "max-age", header: http.Header{"Cache-Control": {"private, max-age=300"}}, want: 5 * time.Minute},
+		{name: "max-age minus age", header: http.Header{"Cache-Control": {"max-age=300"}, "Age": {"100"}}, want: 200 * time.Second},
+		{name: "retry-after seconds", header: http.Header{"Retry-After": {"90"}}, want: 90 * time.Second},
+		{name: "retry-after date", header: http.Header{"Retry-After": {now.Add(time.Hour).Format(http.TimeFormat)}}, want: time.Hour},
+		{name: "longest wins", header: http.Header{"Cache-Control": {"max-age=60"}, "Retry-After": {"30"}}, want: time.Minute},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := pollHint(tc.header, now); got != tc.want {
+				t.Fatalf("pollHint() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDownloadRejectsInvalidResponses(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		validation  config.Validation
+	}{
+		{name: "not found", status: http.StatusNotFound, body: "not found"},
+		{name: "server error", status: http.StatusInternalServerError, body: "oops"},
+		{name: "not accepted", status: http.StatusNoContent, validation: config.Validation{AcceptedStatuses: []int{http.StatusOK}}},
+		{name: "content type", status: http.StatusOK, contentType: "text/html", body: "{}", validation: config.Validation{ContentType: "application/json"}},
+		{name: "too large", status: http.StatusOK, body: "0123456789", validation: config.Validation{MaxSize: 5}},
+		{name: "invalid json", status: http.StatusOK, body: "<html>", validation: config.Validation{Format: FormatJSON}},
+		{name: "invalid yaml", status: http.StatusOK, body: "a: [b", validation: config.Validation{Format: FormatYAML}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.contentType != "" {
+					w.Header().Set("Content-Type", tc.contentType)
+				}
+				w.WriteHeader(tc.status)
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			ctx := context.Background()
+			res := config.ResourceMapping{ResourceType: "configmap", Namespace: "default", Name: "app", Key: "config"}
+			d := newTestDownloader(t, config.URLMap{srv.URL: {ResourceMapping: res, Validation: tc.validation}})
+			good := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}, Data: map[string]string{"config": "good"}}
+			if err := d.k8s.Create(ctx, good); err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+
+			if err := d.download(ctx, srv.URL); err == nil {
+				t.Fatalf("download() expected an error")
+			}
+
+			cm := &corev1.ConfigMap{}
+			if err := d.k8s.Get(ctx, client.ObjectKeyFromObject(good), cm); err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if cm.Data["config"] != "good" {
+				t.Fatalf("config = %q, want the last good content", cm.Data["config"])
+			}
+
+			events := &corev1.EventList{}
+			if err := d.k8s.List(ctx, events); err != nil {
+				t.Fatalf("List() error = %v", err)
+			}
+			if len(events.Items) != 1 || events.Items[0].Reason != "InvalidResponse" || events.Items[0].InvolvedObject.Name != "app" {
+				t.Fatalf("events = %v, want one InvalidResponse event for the ConfigMap", events.Items)
+			}
+		})
+	}
+}
+
+func TestDownloadTimeout(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	res := config.ResourceMapping{ResourceType: "configmap", Namespace: "default", Name: "app", Key: "config"}
+	d := newTestDownloader(t, config.URLMap{srv.URL: {ResourceMapping: res, Timeout: metav1.Duration{Duration: 50 * time.Millisecond}}})
+
+	start := time.Now()
+	if err := d.download(context.Background(), srv.URL); err == nil {
+		t.Fatalf("download() expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("download() took %s, expected it to be bound by the mapping timeout", elapsed)
+	}
+}
+
+func TestStopWaitsForDownloads(t *testing.T) {
+	t.Parallel()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = w.Write([]byte("a: b"))
+	}))
+	defer srv.Close()
+
+	res := config.ResourceMapping{ResourceType: "configmap", Namespace: "default", Name: "app", Key: "config"}
+	d := newTestDownloader(t, config.URLMap{srv.URL: {ResourceMapping: res, Interval: metav1.Duration{Duration: time.Minute}}})
+	d.stop[srv.URL] = make(chan struct{})
+	d.schedule(context.Background(), srv.URL)
+	<-started
+
+	// the in-flight download doesn't finish before the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := d.Stop(ctx); err == nil {
+		t.Fatalf("Stop() expected a timeout error")
+	}
+
+	close(release)
+	if err := d.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	// the download completed and its update was written
+	cm := &corev1.ConfigMap{}
+	if err := d.k8s.Get(context.Background(), client.ObjectKey{Name: "app", Namespace: "default"}, cm); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got := cm.Data["config"]; got != "a: b" {
+		t.Errorf("config = %q, want %q", got, "a: b")
+	}
+}
+
+func TestDownloadToPath(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("a: b"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	d := newTestDownloader(t, config.URLMap{srv.URL: {
+		ResourceMapping: config.ResourceMapping{Key: "app.yaml"},
+		LocalMapping:    config.LocalMapping{Path: dir},
+	}})
+
+	if err := d.download(context.Background(), srv.URL); err != nil {
+		t.Fatalf("download() error = %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "app.yaml"))
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if string(got) != "a: b" {
+		t.Errorf("app.yaml = %q, want %q", got, "a: b")
+	}
+
+	// no resource is written when the mapping only targets a path
+	cms := &corev1.ConfigMapList{}
+	if err := d.k8s.List(context.Background(), cms); err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(cms.Items) != 0 {
+		t.Errorf("got %d ConfigMaps, want 0", len(cms.Items))
+	}
+}
@@ -0,0 +1,137 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/yaml"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+// newJSONPath parses expr, it also accepts the relaxed .a.b and $.a.b forms without the braces
+func newJSONPath(expr string) (*jsonpath.JSONPath, error) {
+	expr = strings.TrimSpace(expr)
+	if !strings.HasPrefix(expr, "{") {
+		expr = strings.TrimPrefix(expr, "$")
+		if !strings.HasPrefix(expr, ".") {
+			expr = "." + expr
+		}
+		expr = "{" + expr + "}"
+	}
+	jp := jsonpath.New("extract")
+	if err := jp.Parse(expr); err != nil {
+		return nil, err
+	}
+	return jp, nil
+}
+
+// validateExtract checks the extraction settings of a mapping
+func validateExtract(cfg config.Extract) error {
+	switch cfg.Format {
+	case "", FormatJSON, FormatYAML:
+	default:
+		return fmt.Errorf("unsupported format: %s", cfg.Format)
+	}
+	if cfg.Path != "" {
+		if _, err := newJSONPath(cfg.Path); err != nil {
+			return fmt.Errorf("invalid path %q: %w", cfg.Path, err)
+		}
+	}
+	return nil
+}
+
+// extract returns the data to store for body, when no extraction is configured the whole body is stored under key
+func extract(body []byte, key string, cfg config.Extract) (map[string][]byte, error) {
+	if cfg.Path == "" && !cfg.FanOut && cfg.Format == "" {
+		return map[string][]byte{key: body}, nil
+	}
+
+	doc, err := decode(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the response: %w", err)
+	}
+
+	if cfg.Path != "" {
+		jp, err := newJSONPath(cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		results, err := jp.FindResults(doc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract %s: %w", cfg.Path, err)
+		}
+		var values []any
+		for _, r := range results {
+			for _, v := range r {
+				values = append(values, v.Interface())
+			}
+		}
+		switch len(values) {
+		case 0:
+			return nil, fmt.Errorf("%s didn't match any value", cfg.Path)
+		case 1:
+			doc = values[0]
+		default:
+			doc = values
+		}
+	}
+
+	if !cfg.FanOut {
+		v, err := encode(doc, cfg.Format)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{key: v}, nil
+	}
+
+	fields, ok := doc.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("can't fan out a %T, the selected value must be an object", doc)
+	}
+	data := make(map[string][]byte, len(fields))
+	for k, field := range fields {
+		if errs := validation.IsConfigMapKey(k); len(errs) > 0 {
+			return nil, fmt.Errorf("field %q isn't a valid key: %s", k, strings.Join(errs, ", "))
+		}
+		v, err := encode(field, cfg.Format)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		data[k] = v
+	}
+	return data, nil
+}
+
+// decode parses a JSON or YAML document, numbers are kept as json.Number so large integers aren't rounded
+func decode(body []byte) (any, error) {
+	if !json.Valid(body) {
+		// YAML is a superset of JSON, so both are accepted
+		var err error
+		if body, err = yaml.YAMLToJSON(body); err != nil {
+			return nil, err
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// encode marshals v in the given format, strings are returned as they are
+func encode(v any, format string) ([]byte, error) {
+	if s, ok := v.(string); ok {
+		return []byte(s), nil
+	}
+	if format == FormatYAML {
+		return yaml.Marshal(v)
+	}
+	return json.Marshal(v)
+}
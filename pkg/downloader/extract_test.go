@@ -0,0 +1,97 @@
+package downloader
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+func TestExtract(t *testing.T) {
+	t.Parallel()
+
+	body := []byte(`{"version": 3, "data": {"app.yaml": "a: b", "limits": {"cpu": 2}}}`)
+
+	tests := []struct {
+		name    string
+		body    string
+		cfg     config.Extract
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "whole body",
+			want: map[string]string{"config": string(body)},
+		},
+		{
+			name: "sub-document",
+			cfg:  config.Extract{Path: "{.data.limits}"},
+			want: map[string]string{"config": `{"cpu":2}`},
+		},
+		{
+			name: "relaxed path as yaml",
+			cfg:  config.Extract{Path: "$.data.limits", Format: FormatYAML},
+			want: map[string]string{"config": "cpu: 2\n"},
+		},
+		{
+			name: "string values are stored as they are",
+			cfg:  config.Extract{Path: `.data.app\.yaml`},
+			want: map[string]string{"config": "a: b"},
+		},
+		{
+			name: "fan out",
+			cfg:  config.Extract{Path: ".data", FanOut: true, Format: FormatYAML},
+			want: map[string]string{"app.yaml": "a: b", "limits": "cpu: 2\n"},
+		},
+		{
+			name:    "fan out a scalar",
+			cfg:     config.Extract{Path: ".version", FanOut: true},
+			wantErr: true,
+		},
+		{
+			name:    "fan out a field that isn't a valid key",
+			body:    `{"a/b": "c", "d": "e"}`,
+			cfg:     config.Extract{FanOut: true},
+			wantErr: true,
+		},
+		{
+			name: "large integers are kept",
+			body: `{"id": 9007199254740993, "nanos": 1700000000123456789, "ratio": 1e+06}`,
+			cfg:  config.Extract{FanOut: true},
+			want: map[string]string{"id": "9007199254740993", "nanos": "1700000000123456789", "ratio": "1e+06"},
+		},
+		{
+			name: "large integers in yaml",
+			body: "id: 9007199254740993\n",
+			cfg:  config.Extract{Path: ".id", Format: FormatYAML},
+			want: map[string]string{"config": "9007199254740993\n"},
+		},
+		{
+			name:    "missing field",
+			cfg:     config.Extract{Path: ".spec"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			in := body
+			if tc.body != "" {
+				in = []byte(tc.body)
+			}
+			data, err := extract(in, "config", tc.cfg)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("extract() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			got := make(map[string]string, len(data))
+			for k, v := range data {
+				got[k] = string(v)
+			}
+			if !tc.wantErr && !maps.Equal(got, tc.want) {
+				t.Errorf("extract() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
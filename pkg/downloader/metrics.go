@@ -0,0 +1,18 @@
+package downloader
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var rejections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "configmapper_downloader_rejected_responses_total",
+		Help: "Number of responses that failed validation and were not stored, by URL and reason",
+	},
+	[]string{"url", "reason"},
+)
+
+func init() {
+	metrics.Registry.MustRegister(rejections)
+}
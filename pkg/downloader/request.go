@@ -0,0 +1,117 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/go-retryablehttp"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+	"github.com/luisdavim/configmapper/pkg/utils"
+)
+
+// newClient returns an HTTP client configured for the requests described by cfg
+func newClient(cfg config.Request) (*retryablehttp.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.Proxy != "" {
+		proxy, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.TLS.InsecureSkipVerify, //nolint:gosec // explicitly requested
+	}
+	if cfg.TLS.CAFile != "" {
+		ca, err := os.ReadFile(cfg.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.TLS.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.TLS.CertFile != "" || cfg.TLS.KeyFile != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile); err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %w", err)
+		}
+		// load the certificate on each handshake so it can be rotated
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+			return &cert, err
+		}
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	c := retryablehttp.NewClient()
+	c.HTTPClient.Transport = transport
+	c.HTTPClient.Timeout = cfg.Timeout.Duration
+	// return the last response when giving up so its Retry-After header can be honored
+	c.ErrorHandler = retryablehttp.PassthroughErrorHandler
+	switch {
+	case cfg.Retry.Max < 0:
+		c.RetryMax = 0
+	case cfg.Retry.Max > 0:
+		c.RetryMax = cfg.Retry.Max
+	}
+	if cfg.Retry.WaitMin.Duration > 0 {
+		c.RetryWaitMin = cfg.Retry.WaitMin.Duration
+	}
+	if cfg.Retry.WaitMax.Duration > 0 {
+		c.RetryWaitMax = cfg.Retry.WaitMax.Duration
+	}
+
+	return c, nil
+}
+
+// newRequest returns the request for url, bound to ctx, with the method, body, headers and credentials set in cfg,
+// Secrets are read from namespace when their reference doesn't set one
+func (d *Downloader) newRequest(ctx context.Context, u string, cfg config.Request, namespace string) (*retryablehttp.Request, error) {
+	method := http.MethodGet
+	if cfg.Method != "" {
+		method = strings.ToUpper(cfg.Method)
+	}
+	var body any
+	if cfg.Body != "" {
+		body = bytes.NewReader([]byte(cfg.Body))
+	}
+
+	req, err := retryablehttp.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	token, err := utils.ReadValue(ctx, cfg.Auth.BearerToken, namespace, d.k8s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the bearer token: %w", err)
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+string(token))
+	}
+
+	if cfg.Auth.Username != "" {
+		password, err := utils.ReadValue(ctx, cfg.Auth.Password, namespace, d.k8s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the password: %w", err)
+		}
+		req.SetBasicAuth(cfg.Auth.Username, string(password))
+	}
+
+	return req, nil
+}
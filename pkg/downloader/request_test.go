@@ -0,0 +1,82 @@
+package downloader
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+func TestDownloadRequestConfig(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		user, password, _ := r.BasicAuth()
+		if r.Method != http.MethodPost || string(body) != `{"env":"prod"}` || r.Header.Get("X-Tenant") != "a" ||
+			user != "svc" || password != "s3cr3t" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: "default"}, Data: map[string][]byte{"password": []byte("s3cr3t\n")}}
+	res := config.ResourceMapping{ResourceType: "configmap", Namespace: "default", Name: "app", Key: "config"}
+	req := config.Request{
+		Method:  "post",
+		Body:    `{"env":"prod"}`,
+		Headers: map[string]string{"X-Tenant": "a"},
+		Auth: config.Auth{
+			Username: "svc",
+			Password: config.ValueFrom{Secret: config.SecretKeyRef{Name: "creds", Key: "password"}},
+		},
+		TLS: config.TLS{CAFile: caFile},
+	}
+	d := newTestDownloader(t, config.URLMap{srv.URL: {ResourceMapping: res, Request: req}}, secret)
+
+	if err := d.download(ctx, srv.URL); err != nil {
+		t.Fatalf("download() error = %v", err)
+	}
+}
+
+func TestNewRequestBearerToken(t *testing.T) {
+	t.Parallel()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("abc\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newTestDownloader(t, nil)
+	req, err := d.newRequest(context.Background(), "https://example.com", config.Request{
+		Auth: config.Auth{BearerToken: config.ValueFrom{File: tokenFile}},
+	}, "default")
+	if err != nil {
+		t.Fatalf("newRequest() error = %v", err)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer abc" {
+		t.Fatalf("Authorization = %q, want %q", got, "Bearer abc")
+	}
+	if req.Method != http.MethodGet {
+		t.Fatalf("Method = %s, want %s", req.Method, http.MethodGet)
+	}
+}
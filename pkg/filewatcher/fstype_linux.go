@@ -0,0 +1,24 @@
+package filewatcher
+
+import "golang.org/x/sys/unix"
+
+// remoteFilesystems are the filesystems where inotify doesn't report changes made by other hosts
+var remoteFilesystems = map[int64]bool{
+	unix.AFS_SUPER_MAGIC:  true,
+	unix.CEPH_SUPER_MAGIC: true,
+	unix.CIFS_SUPER_MAGIC: true,
+	unix.CODA_SUPER_MAGIC: true,
+	unix.FUSE_SUPER_MAGIC: true,
+	unix.NFS_SUPER_MAGIC:  true,
+	unix.SMB2_SUPER_MAGIC: true,
+	unix.SMB_SUPER_MAGIC:  true,
+}
+
+// isRemoteFS returns true if path is on a filesystem that doesn't support change notifications
+func isRemoteFS(path string) bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return false
+	}
+	return remoteFilesystems[int64(st.Type)]
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package filewatcher
+
+// isRemoteFS always returns false, the filesystem type is only detected on Linux
+func isRemoteFS(_ string) bool {
+	return false
+}
@@ -0,0 +1,100 @@
+package filewatcher
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+// isGlob returns true if path contains any glob meta characters
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// globBase returns the longest leading directory of pattern without any glob meta characters
+func globBase(pattern string) string {
+	segments := strings.Split(filepath.Clean(pattern), string(filepath.Separator))
+	for i, s := range segments {
+		if isGlob(s) {
+			base := strings.Join(segments[:i], string(filepath.Separator))
+			if base == "" {
+				if filepath.IsAbs(pattern) {
+					return string(filepath.Separator)
+				}
+				return "."
+			}
+			return base
+		}
+	}
+	return filepath.Dir(pattern)
+}
+
+// globIsRecursive returns true if pattern can match files in subdirectories of its base
+func globIsRecursive(pattern string) bool {
+	rel, err := filepath.Rel(globBase(pattern), pattern)
+	if err != nil {
+		return true
+	}
+	return strings.Contains(rel, string(filepath.Separator)) || strings.Contains(rel, "**")
+}
+
+// globDepth returns how many levels below its base pattern can match files at, or -1 when it has a "**" segment
+func globDepth(pattern string) int {
+	rel, err := filepath.Rel(globBase(pattern), pattern)
+	if err != nil || strings.Contains(rel, "**") {
+		return -1
+	}
+	return len(strings.Split(rel, string(filepath.Separator)))
+}
+
+// globMatch reports whether name matches pattern,
+// in addition to the filepath.Match syntax, a "**" segment matches zero or more directories
+func globMatch(pattern, name string) bool {
+	sep := string(filepath.Separator)
+	return matchSegments(strings.Split(filepath.Clean(pattern), sep), strings.Split(filepath.Clean(name), sep))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// selected applies the mapping's include and exclude patterns to rel, a path relative to the mapped directory,
+// patterns without a path separator are matched against the file name only
+func selected(cfg config.FileMapping, rel string) bool {
+	matches := func(patterns []string) bool {
+		for _, p := range patterns {
+			name := rel
+			if !strings.Contains(p, string(filepath.Separator)) {
+				name = filepath.Base(rel)
+			}
+			if globMatch(p, name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(cfg.Include) > 0 && !matches(cfg.Include) {
+		return false
+	}
+
+	return !matches(cfg.Exclude)
+}
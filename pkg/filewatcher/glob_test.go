@@ -0,0 +1,172 @@
+package filewatcher
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+func TestGlobMatch(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{pattern: "/etc/app/*.yaml", name: "/etc/app/config.yaml", want: true},
+		{pattern: "/etc/app/*.yaml", name: "/etc/app/nested/config.yaml", want: false},
+		{pattern: "/etc/app/**/conf.d/*.conf", name: "/etc/app/conf.d/a.conf", want: true},
+		{pattern: "/etc/app/**/conf.d/*.conf", name: "/etc/app/x/y/conf.d/a.conf", want: true},
+		{pattern: "/etc/app/**/conf.d/*.conf", name: "/etc/app/x/conf.d/a.yaml", want: false},
+		{pattern: "**", name: "a/b/c", want: true},
+	}
+
+	for _, tc := range tests {
+		if got := globMatch(tc.pattern, tc.name); got != tc.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestGlobBase(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"/etc/app/*.yaml":           "/etc/app",
+		"/etc/app/**/conf.d/*.conf": "/etc/app",
+		"/etc/*/app/config.yaml":    "/etc",
+		"/*.yaml":                   "/",
+		"/etc/app/config-[ab].yaml": "/etc/app",
+		"*.yaml":                    ".",
+		"**/conf.d/*.conf":          ".",
+		"conf.d/*.conf":             "conf.d",
+	}
+
+	for pattern, want := range tests {
+		if got := globBase(pattern); got != want {
+			t.Errorf("globBase(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+func TestGlobDepth(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]int{
+		"/etc/*.conf":               1,
+		"/etc/*/app/config.yaml":    3,
+		"/etc/app/**/conf.d/*.conf": -1,
+		"*.yaml":                    1,
+		"**/conf.d/*.conf":          -1,
+	}
+
+	for pattern, want := range tests {
+		if got := globDepth(pattern); got != want {
+			t.Errorf("globDepth(%q) = %d, want %d", pattern, got, want)
+		}
+	}
+}
+
+func TestWalkFilesStopsAtDepth(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for _, f := range []string{"a.conf", "x/b.conf", "x/y/c.conf"} {
+		path := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("MkdirAll() error = %v", err)
+		}
+		if err := os.WriteFile(path, []byte(f), 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	tests := map[int][]string{
+		1:  {"a.conf"},
+		2:  {"a.conf", "x/b.conf"},
+		-1: {"a.conf", "x/b.conf", "x/y/c.conf"},
+	}
+	for depth, want := range tests {
+		files, err := walkFiles(dir, depth)
+		if err != nil {
+			t.Fatalf("walkFiles() error = %v", err)
+		}
+		var got []string
+		for _, f := range files {
+			rel, _ := filepath.Rel(dir, f)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("walkFiles(%d) = %v, want %v", depth, got, want)
+		}
+	}
+}
+
+func TestGetDataRecursiveWithFilters(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.yaml":           "one",
+		"README.md":             "skip",
+		"conf.d/app.yaml":       "two",
+		"conf.d/tmp/cache.yaml": "excluded",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("MkdirAll() error = %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	data, err := getData(dir, config.FileMapping{
+		Recursive: true,
+		Include:   []string{"*.yaml"},
+		Exclude:   []string{"conf.d/tmp/*"},
+	})
+	if err != nil {
+		t.Fatalf("getData() error = %v", err)
+	}
+
+	want := map[string][]byte{
+		"config.yaml":      []byte("one"),
+		"conf.d__app.yaml": []byte("two"),
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Fatalf("getData() = %v, want %v", data, want)
+	}
+
+	data, err = getData(filepath.Join(dir, "**", "*.yaml"), config.FileMapping{})
+	if err != nil {
+		t.Fatalf("getData() error = %v", err)
+	}
+	if len(data) != 3 {
+		t.Fatalf("getData() = %v, want 3 keys", data)
+	}
+}
+
+func TestGetDataDetectsKeyCollisions(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a"), 0o755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a", "b"), []byte("one"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a__b"), []byte("two"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	if _, err := getData(dir, config.FileMapping{Recursive: true}); err == nil {
+		t.Fatalf("getData() error = nil, want key collision")
+	}
+}
@@ -0,0 +1,18 @@
+package filewatcher
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var deletions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "configmapper_filewatcher_deletions_total",
+		Help: "Number of deleted files handled by the file watcher, by mapping and deletion policy",
+	},
+	[]string{"path", "policy"},
+)
+
+func init() {
+	metrics.Registry.MustRegister(deletions)
+}
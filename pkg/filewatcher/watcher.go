@@ -2,12 +2,18 @@ package filewatcher
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/hashicorp/go-retryablehttp"
@@ -19,15 +25,70 @@ import (
 	"github.com/luisdavim/configmapper/pkg/utils"
 )
 
+const (
+	// DefaultRetryInterval is the initial delay before retrying a failed startup sync
+	DefaultRetryInterval = time.Second
+	// MaxRetryInterval caps the backoff between startup sync retries
+	MaxRetryInterval = 5 * time.Minute
+	// DefaultQuietPeriod is how long to wait for more events before running a mapping
+	DefaultQuietPeriod = 100 * time.Millisecond
+	// DefaultMaxWait is the longest a mapping can be delayed by a burst of events
+	DefaultMaxWait = time.Second
+	// DefaultPollInterval is how often files are checked for changes when polling
+	DefaultPollInterval = 10 * time.Second
+	// DefaultTimeout bounds each run of a mapping
+	DefaultTimeout = 30 * time.Second
+)
+
+const (
+	// ModeNotify watches for filesystem events
+	ModeNotify = "notify"
+	// ModePoll periodically checks the files for changes
+	ModePoll = "poll"
+	// ModeAuto watches for filesystem events and falls back to polling when that's not possible
+	ModeAuto = "auto"
+)
+
+const (
+	// OnDeleteKeep leaves the resource as is when the mapped path is deleted
+	OnDeleteKeep = "keep"
+	// OnDeleteRemoveKey removes the mapping's keys from the resource when the mapped path is deleted
+	OnDeleteRemoveKey = "removeKey"
+	// OnDeleteDelete deletes the resource when the mapped path is deleted
+	OnDeleteDelete = "delete"
+)
+
+// burst tracks the events received for a mapping that hasn't run yet
+type burst struct {
+	first  time.Time
+	last   time.Time
+	events int
+}
+
 type Watcher struct {
 	config config.FileMap
 	fw     *fsnotify.Watcher
 	log    zerolog.Logger
 	k8s    client.Client
 	http   *retryablehttp.Client
+	// pending maps paths that don't exist yet to the parent directory being watched for them
+	pending map[string]string
+	// bursts holds the mappings waiting for their quiet period to elapse
+	bursts map[string]*burst
+	// links maps the directories watched on behalf of file mappings to their keys
+	links map[string][]string
+	// hashes holds the digest of the data last synced for each mapping
+	hashes map[string]string
+	// polls holds when each polled mapping is due to be checked next
+	polls map[string]time.Time
+	// stats holds a digest of the file sizes and modification times seen by the last poll of each mapping
+	stats map[string]string
+	// keys holds the resource keys last synced for each mapping
+	keys map[string][]string
+	sync.RWMutex
 }
 
-func New(cfg config.FileMap) (*Watcher, error) {
+func New(cfg config.FileMap, defaults config.WatchMode) (*Watcher, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
@@ -43,11 +104,25 @@ func New(cfg config.FileMap) (*Watcher, error) {
 	}
 
 	w := &Watcher{
-		config: cfg,
-		fw:     watcher,
-		log:    zerolog.New(os.Stderr).With().Timestamp().Str("name", "filewatcher").Logger().Level(zerolog.InfoLevel),
-		http:   retryablehttp.NewClient(),
-		k8s:    c,
+		config:  cfg,
+		fw:      watcher,
+		log:     zerolog.New(os.Stderr).With().Timestamp().Str("name", "filewatcher").Logger().Level(zerolog.InfoLevel),
+		http:    retryablehttp.NewClient(),
+		k8s:     c,
+		pending: make(map[string]string),
+		bursts:  make(map[string]*burst),
+		links:   make(map[string][]string),
+		hashes:  make(map[string]string),
+		polls:   make(map[string]time.Time),
+		stats:   make(map[string]string),
+		keys:    make(map[string][]string),
+	}
+
+	if defaults.Mode == "" {
+		defaults.Mode = ModeNotify
+	}
+	if defaults.PollInterval.Duration == 0 {
+		defaults.PollInterval.Duration = DefaultPollInterval
 	}
 
 	curNS, _ := utils.GetInClusterNamespace()
@@ -68,46 +143,491 @@ func New(cfg config.FileMap) (*Watcher, error) {
 			c.Signal = syscall.SIGHUP
 			w.config[file] = c
 		}
-		err := watcher.Add(file)
-		if err != nil {
+		if c.Debounce.QuietPeriod.Duration == 0 {
+			c.Debounce.QuietPeriod.Duration = DefaultQuietPeriod
+			w.config[file] = c
+		}
+		if c.Debounce.MaxWait.Duration == 0 {
+			c.Debounce.MaxWait.Duration = DefaultMaxWait
+			w.config[file] = c
+		}
+		if c.Mode == "" {
+			c.Mode = defaults.Mode
+			w.config[file] = c
+		}
+		if c.Mode != ModeNotify && c.Mode != ModePoll && c.Mode != ModeAuto {
+			return nil, fmt.Errorf("invalid mode for %s: %s", file, c.Mode)
+		}
+		if c.PollInterval.Duration == 0 {
+			c.PollInterval.Duration = defaults.PollInterval.Duration
+			w.config[file] = c
+		}
+		if c.Strategy == "" {
+			c.Strategy = utils.StrategyReplace
+			w.config[file] = c
+		}
+		if err := utils.ValidateResource(c.ResourceMapping); err != nil {
+			return nil, fmt.Errorf("invalid resource mapping for %s: %w", file, err)
+		}
+		if c.Timeout.Duration == 0 {
+			c.Timeout.Duration = DefaultTimeout
+			w.config[file] = c
+		}
+		if c.OnDelete == "" {
+			c.OnDelete = OnDeleteKeep
+			w.config[file] = c
+		}
+		if c.OnDelete != OnDeleteKeep && c.OnDelete != OnDeleteRemoveKey && c.OnDelete != OnDeleteDelete {
+			return nil, fmt.Errorf("invalid onDelete policy for %s: %s", file, c.OnDelete)
+		}
+		if err := w.watch(file); err != nil {
 			return nil, err
 		}
 	}
 	return w, nil
 }
 
+// watch adds a watch for the path mapped by key, if the path doesn't exist yet,
+// its nearest existing parent directory is watched instead until it's created
+func (w *Watcher) watch(key string) error {
+	cfg := w.config[key]
+	root, _ := w.watchRoot(key)
+
+	if cfg.Mode == ModeAuto {
+		dir := root
+		if _, err := os.Stat(root); err != nil {
+			dir = nearestParent(root)
+		}
+		if isRemoteFS(dir) {
+			w.usePolling(key, "filesystem doesn't support change notifications")
+			return nil
+		}
+	}
+
+	if cfg.Mode == ModePoll {
+		return w.checkPolled(key, root)
+	}
+
+	err := w.addWatch(key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) && cfg.Mode == ModeAuto {
+		w.usePolling(key, err.Error())
+		return nil
+	}
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	dir := nearestParent(root)
+	if err := w.fw.Add(dir); err != nil {
+		return fmt.Errorf("failed to watch %s for %s: %w", dir, key, err)
+	}
+
+	w.Lock()
+	w.pending[key] = dir
+	w.Unlock()
+	w.log.Warn().Str("path", key).Str("parent", dir).Msg("path doesn't exist yet, waiting for it to be created")
+
+	return nil
+}
+
+// usePolling switches the mapping for key to poll mode
+func (w *Watcher) usePolling(key, reason string) {
+	cfg := w.config[key]
+	cfg.Mode = ModePoll
+	w.config[key] = cfg
+	w.log.Warn().Str("path", key).Str("reason", reason).Msgf("falling back to polling every %s", cfg.PollInterval.Duration)
+
+	root, _ := w.watchRoot(key)
+	_ = w.checkPolled(key, root)
+}
+
+// checkPolled marks a polled mapping as pending while its path doesn't exist and schedules its next poll
+func (w *Watcher) checkPolled(key, root string) error {
+	if _, ok := w.polls[key]; !ok {
+		w.polls[key] = time.Now().Add(w.config[key].PollInterval.Duration)
+	}
+
+	_, err := os.Stat(root)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if err != nil {
+		if _, ok := w.pending[key]; !ok {
+			// there's no parent watch for polled paths
+			w.pending[key] = ""
+			w.log.Warn().Str("path", key).Msg("path doesn't exist yet, waiting for it to be created")
+		}
+		return nil
+	}
+	delete(w.pending, key)
+	return nil
+}
+
+// poll checks whether the files mapped by key changed since the last poll and queues the mapping if they did
+func (w *Watcher) poll(ctx context.Context, key string, now time.Time) {
+	cfg := w.config[key]
+	w.polls[key] = now.Add(cfg.PollInterval.Duration)
+
+	root, _ := w.watchRoot(key)
+	wasPending := w.isPending(key)
+	if err := w.checkPolled(key, root); err != nil {
+		w.log.Err(err).Str("path", key).Msg("polling")
+		return
+	}
+	if w.isPending(key) {
+		delete(w.stats, key)
+		if !wasPending {
+			w.handleDelete(ctx, key)
+		}
+		return
+	}
+
+	sum, err := statFiles(key, cfg)
+	if err != nil {
+		w.log.Err(err).Str("path", key).Msg("polling")
+		return
+	}
+	if sum == w.stats[key] && !wasPending {
+		return
+	}
+	w.stats[key] = sum
+	w.queueKey(key, now)
+}
+
+// nextPoll returns when the next polled mapping is due
+func (w *Watcher) nextPoll() (time.Time, bool) {
+	var next time.Time
+	for _, due := range w.polls {
+		if next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// statFiles returns a digest of the sizes and modification times of the files mapped by key
+func statFiles(key string, cfg config.FileMapping) (string, error) {
+	files, err := getFiles(key, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	stats := make(map[string]string, len(files))
+	for k, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return "", err
+		}
+		stats[k] = fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+	}
+
+	return utils.Hash(stats), nil
+}
+
+// watchRoot returns the path watched for key and whether its subdirectories need to be watched too
+func (w *Watcher) watchRoot(key string) (string, bool) {
+	if isGlob(key) {
+		return globBase(key), globIsRecursive(key)
+	}
+	return key, w.config[key].Recursive
+}
+
+// addWatch watches the path mapped by key and, for recursive mappings, all of its subdirectories
+func (w *Watcher) addWatch(key string) error {
+	root, recursive := w.watchRoot(key)
+	if recursive {
+		return w.watchTree(root)
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return w.fw.Add(root)
+	}
+
+	// editors and the kubelet replace files instead of writing to them,
+	// so watch the directories holding the file and any symlinks pointing to it
+	for _, path := range linkPaths(root) {
+		dir := filepath.Dir(path)
+		if err := w.fw.Add(dir); err != nil {
+			return err
+		}
+		if !slices.Contains(w.links[dir], key) {
+			w.links[dir] = append(w.links[dir], key)
+		}
+	}
+
+	return nil
+}
+
+// watchTree watches root and all of its subdirectories
+func (w *Watcher) watchTree(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && isHidden(path) {
+			return fs.SkipDir
+		}
+		return w.fw.Add(path)
+	})
+}
+
+// linkPaths returns path followed by the targets of the chain of symlinks it points to,
+// the kubelet's internal directories are left out since they're replaced on every update.
+func linkPaths(path string) []string {
+	paths := []string{path}
+	for range 255 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			break
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		if isHidden(filepath.Dir(target)) {
+			break
+		}
+		path = target
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// isHidden returns true for the timestamped directories and the ..data symlink
+// the kubelet uses to atomically update ConfigMap and Secret volumes
+func isHidden(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), "..")
+}
+
+// inRecursiveTree returns true if dir is a subdirectory of a recursively watched mapping
+func (w *Watcher) inRecursiveTree(dir string) bool {
+	for key := range w.config {
+		if w.isPending(key) {
+			continue
+		}
+		if root, recursive := w.watchRoot(key); recursive && isSubPath(root, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePending checks whether any of the pending paths were created,
+// when they were, the parent watch is replaced by a watch on the path itself and the mapping is run.
+// Polled paths are skipped.
+func (w *Watcher) resolvePending(ctx context.Context) {
+	w.RLock()
+	pending := make(map[string]string, len(w.pending))
+	for path, dir := range w.pending {
+		pending[path] = dir
+	}
+	w.RUnlock()
+
+	for path, dir := range pending {
+		if w.config[path].Mode == ModePoll {
+			// polled paths are resolved by poll, without adding watches
+			continue
+		}
+		root, _ := w.watchRoot(path)
+		if _, err := os.Stat(root); err != nil {
+			// an intermediate directory may have been created, move the watch closer to the path
+			if next := nearestParent(root); next != dir {
+				if err := w.fw.Add(next); err != nil {
+					w.log.Err(err).Str("path", path).Str("parent", next).Msg("updating pending watch")
+					continue
+				}
+				w.Lock()
+				w.pending[path] = next
+				w.Unlock()
+				w.unwatchParent(dir)
+			}
+			continue
+		}
+
+		if err := w.addWatch(path); err != nil {
+			w.log.Err(err).Str("path", path).Msg("adding file watch")
+			continue
+		}
+		w.Lock()
+		delete(w.pending, path)
+		w.Unlock()
+		w.unwatchParent(dir)
+
+		err := w.sync(ctx, path, w.config[path], true)
+		w.log.Err(err).Str("path", path).Msg("path created, updating config")
+	}
+}
+
+// unwatchParent removes the watch from dir unless it's still needed
+func (w *Watcher) unwatchParent(dir string) {
+	if _, ok := w.config[dir]; ok {
+		return
+	}
+	if w.inRecursiveTree(dir) {
+		return
+	}
+	if len(w.links[dir]) > 0 {
+		return
+	}
+	w.RLock()
+	for _, d := range w.pending {
+		if d == dir {
+			w.RUnlock()
+			return
+		}
+	}
+	w.RUnlock()
+	if err := w.fw.Remove(dir); err != nil {
+		w.log.Err(err).Str("path", dir).Msg("removing parent watch")
+	}
+}
+
+// isPending returns true if path is waiting to be created
+func (w *Watcher) isPending(path string) bool {
+	w.RLock()
+	defer w.RUnlock()
+	_, ok := w.pending[path]
+	return ok
+}
+
+// isPendingParent returns true if dir is being watched for a path that doesn't exist yet
+func (w *Watcher) isPendingParent(dir string) bool {
+	w.RLock()
+	defer w.RUnlock()
+	for _, d := range w.pending {
+		if d == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// Pending returns the paths that don't exist yet
+func (w *Watcher) Pending() []string {
+	w.RLock()
+	defer w.RUnlock()
+	paths := make([]string, 0, len(w.pending))
+	for path := range w.pending {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// Ready is a readiness check that fails while any of the watched paths don't exist
+func (w *Watcher) Ready(_ *http.Request) error {
+	if pending := w.Pending(); len(pending) > 0 {
+		return fmt.Errorf("waiting for: %s", strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+// isSubPath returns true if path is dir or is inside dir
+func isSubPath(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// nearestParent returns the closest existing parent directory of path
+func nearestParent(path string) string {
+	dir := filepath.Dir(path)
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
 func (w *Watcher) Start(ctx context.Context) error {
 	defer func() { _ = w.fw.Close() }()
 	if len(w.config) == 0 {
 		return nil
 	}
+
+	w.prune(ctx)
+
+	// make sure the mapped resources reflect the current state of the files
+	// before waiting for changes
+	failed := w.initialSync(ctx)
+	backoff := DefaultRetryInterval
+	retry := time.NewTimer(backoff)
+	defer retry.Stop()
+	if len(failed) == 0 {
+		retry.Stop()
+	}
+
+	flush := time.NewTimer(0)
+	defer flush.Stop()
+	<-flush.C
+
+	poll := time.NewTimer(0)
+	defer poll.Stop()
+	<-poll.C
+
+	// reset points the timers at the next due mappings
+	reset := func() {
+		if next, ok := w.nextFlush(); ok {
+			flush.Reset(time.Until(next))
+		}
+		if next, ok := w.nextPoll(); ok {
+			poll.Reset(time.Until(next))
+		}
+	}
+	reset()
+
 	for {
 		select {
+		case now := <-poll.C:
+			for key, due := range w.polls {
+				if !due.After(now) {
+					w.poll(ctx, key, now)
+				}
+			}
+			reset()
+		case now := <-flush.C:
+			w.flush(ctx, now)
+			reset()
+		case <-retry.C:
+			failed = w.retrySync(ctx, failed)
+			if len(failed) > 0 {
+				backoff = nextBackoff(backoff)
+				w.log.Warn().Int("pending", len(failed)).Msgf("retrying initial sync in %s", backoff)
+				retry.Reset(backoff)
+			}
 		case event := <-w.fw.Events:
 			if event.Has(fsnotify.Chmod) {
 				continue
 			}
-			// k8s ConfigMaps use symlinks, we need this workaround.
-			// original ConfigMap file is removed
-			if event.Has(fsnotify.Remove) {
-				// remove the watch since the file is removed
-				if err := w.fw.Remove(event.Name); err != nil {
-					w.log.Err(err).Msg("removing file watch")
-				}
-				// add a new watcher pointing to the new symlink/file
-				if err := w.fw.Add(event.Name); err != nil {
-					w.log.Err(err).Msg("updating file watch")
-				}
-				err := w.do(ctx, event.Name)
-				w.log.Err(err).Str("path", event.Name).Msg("updating config")
-				continue
+			dir := filepath.Dir(event.Name)
+			if w.isPendingParent(dir) && (event.Has(fsnotify.Create) || event.Has(fsnotify.Rename)) {
+				w.resolvePending(ctx)
 			}
-			// also allow normal files to be modified and reloaded.
-			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) {
-				err := w.do(ctx, event.Name)
-				w.log.Err(err).Str("path", event.Name).Msg("updating config")
-				continue
+			// watch new subdirectories of recursive mappings
+			if event.Has(fsnotify.Create) && !isHidden(event.Name) && w.inRecursiveTree(dir) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := w.watchTree(event.Name); err != nil {
+						w.log.Err(err).Str("path", event.Name).Msg("adding directory watch")
+					}
+				}
 			}
+			// atomic saves and k8s ConfigMap updates rename or remove the original files,
+			// all events are queued and the mapping runs once things settle down
+			w.queue(event.Name, time.Now())
+			reset()
 		case err := <-w.fw.Errors:
 			w.log.Err(err).Msg("file watch")
 		case <-ctx.Done():
@@ -116,6 +636,56 @@ func (w *Watcher) Start(ctx context.Context) error {
 	}
 }
 
+// initialSync runs every mapping once and returns the paths that failed to sync
+func (w *Watcher) initialSync(ctx context.Context) map[string]error {
+	failed := make(map[string]error)
+	for path, cfg := range w.config {
+		if cfg.InitialSync.Disabled {
+			continue
+		}
+		if cfg.Name == "" && cfg.ProcessName == "" {
+			continue
+		}
+		if w.isPending(path) {
+			// the mapping will run once the path is created
+			continue
+		}
+		err := w.sync(ctx, path, cfg, cfg.InitialSync.Signal)
+		w.log.Err(err).Str("operation", "sync").Str("path", path).Msg("initial sync")
+		if err != nil {
+			failed[path] = err
+		}
+	}
+	return failed
+}
+
+// retrySync runs the mappings that previously failed and returns the ones that are still failing
+func (w *Watcher) retrySync(ctx context.Context, failed map[string]error) map[string]error {
+	for path := range failed {
+		if w.isPending(path) {
+			delete(failed, path)
+			continue
+		}
+		cfg := w.config[path]
+		err := w.sync(ctx, path, cfg, cfg.InitialSync.Signal)
+		w.log.Err(err).Str("operation", "sync").Str("path", path).Msg("retrying initial sync")
+		if err != nil {
+			failed[path] = err
+			continue
+		}
+		delete(failed, path)
+	}
+	return failed
+}
+
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > MaxRetryInterval {
+		return MaxRetryInterval
+	}
+	return d
+}
+
 func getFilesFromPath(path string) ([]string, error) {
 	info, err := os.Stat(path)
 	if err != nil {
@@ -134,56 +704,332 @@ func getFilesFromPath(path string) ([]string, error) {
 
 	var files []string
 	for _, entry := range entries {
-		if entry.IsDir() {
+		if entry.IsDir() || isHidden(entry.Name()) {
 			continue
 		}
-		files = append(files, filepath.Join(path, entry.Name()))
+		file := filepath.Join(path, entry.Name())
+		if entry.Type()&fs.ModeSymlink != 0 {
+			// skip symlinks to directories
+			if info, err := os.Stat(file); err != nil || info.IsDir() {
+				continue
+			}
+		}
+		files = append(files, file)
 	}
 
 	return files, nil
 }
 
-func getData(path string) (map[string]string, error) {
-	data := make(map[string]string)
-	files, err := getFilesFromPath(path)
+// walkFiles returns all the files in root and its subdirectories,
+// up to depth levels below root, or at any depth when depth is negative
+func walkFiles(root string, depth int) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != root && isHidden(path) {
+			// the kubelet's internal entries, the files are read through the symlinks that point to them
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if depth >= 0 && path != root {
+				// the files in this directory would be deeper than depth
+				if rel, err := filepath.Rel(root, path); err == nil && len(strings.Split(rel, string(filepath.Separator))) >= depth {
+					return fs.SkipDir
+				}
+			}
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			// skip symlinks to directories
+			if info, err := os.Stat(path); err != nil || info.IsDir() {
+				return nil
+			}
+		}
+		files = append(files, path)
+		return nil
+	})
+	return files, err
+}
+
+// getFiles returns the files mapped by path indexed by their ConfigMap key
+func getFiles(path string, cfg config.FileMapping) (map[string]string, error) {
+	var (
+		root  = path
+		files []string
+		err   error
+	)
+
+	switch {
+	case isGlob(path):
+		root = globBase(path)
+		all, err := walkFiles(root, globDepth(path))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range all {
+			if globMatch(path, f) {
+				files = append(files, f)
+			}
+		}
+	case cfg.Recursive:
+		files, err = walkFiles(path, -1)
+	default:
+		files, err = getFilesFromPath(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]string, len(files))
+	for _, f := range files {
+		rel, err := filepath.Rel(root, f)
+		if err != nil || rel == "." {
+			rel = filepath.Base(f)
+		}
+		if !selected(cfg, rel) {
+			continue
+		}
+		key := utils.EncodeKey(rel)
+		if other, ok := keys[key]; ok {
+			return nil, fmt.Errorf("%s and %s map to the same key: %s", other, f, key)
+		}
+		keys[key] = f
+	}
+
+	return keys, nil
+}
+
+func getData(path string, cfg config.FileMapping) (map[string][]byte, error) {
+	data := make(map[string][]byte)
+	files, err := getFiles(path, cfg)
 	if err != nil {
 		return data, err
 	}
 
-	for _, fileName := range files {
+	for key, fileName := range files {
 		b, err := os.ReadFile(fileName)
 		if err != nil {
 			return data, err
 		}
-		data[filepath.Base(fileName)] = string(b)
+		data[key] = b
 	}
 
 	return data, nil
 }
 
-func (w *Watcher) do(ctx context.Context, path string) error {
-	cfg, ok := w.config[path]
+// match returns the config key for path
+func (w *Watcher) match(path string) (string, bool) {
+	if _, ok := w.config[path]; ok {
+		return path, true
+	}
+
+	var longestMatch string
+	// the path may point to a file in a watched folder
+	for p := range w.config {
+		if isGlob(p) {
+			if globMatch(p, path) && len(p) > len(longestMatch) {
+				longestMatch = p
+			}
+			continue
+		}
+		if isSubPath(p, path) {
+			if len(p) > len(longestMatch) {
+				longestMatch = p
+			}
+			// TODO: should we run all matching configs or just the longest matching one?
+		}
+	}
+
+	return longestMatch, longestMatch != ""
+}
+
+// affected returns the keys of the mappings that need to run when path changes
+func (w *Watcher) affected(path string) []string {
+	var keys []string
+	add := func(key string) {
+		if !w.isPending(key) && !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	if key, ok := w.match(path); ok {
+		root, _ := w.watchRoot(key)
+		rel, err := filepath.Rel(root, path)
+		if path == key || isHidden(path) || err != nil || selected(w.config[key], rel) {
+			add(key)
+		}
+	}
+
+	// file mappings are watched through their directories
+	for _, key := range w.links[filepath.Dir(path)] {
+		if isHidden(path) || slices.Contains(linkPaths(key), path) {
+			add(key)
+		}
+	}
+
+	return keys
+}
+
+// queue records an event for path, the mapping runs once no more events are received for its quiet period
+// events for different files of the same mapping are coalesced into a single update
+func (w *Watcher) queue(path string, now time.Time) {
+	for _, key := range w.affected(path) {
+		w.queueKey(key, now)
+	}
+}
+
+// queueKey records an event for the mapping of key
+func (w *Watcher) queueKey(key string, now time.Time) {
+	b, ok := w.bursts[key]
 	if !ok {
-		var longestMatch string
-		// the path may point to a file in a watched folder
-		for p := range w.config {
-			if strings.HasPrefix(path, p) {
-				if len(p) > len(longestMatch) {
-					longestMatch = p
-				}
-				// TODO: should we run all matching configs or just the longest matching one?
-				// if err := w.do(ctx, n); err != nil {
-				// 	w.log.Err(err).Str("path", n).Msg("updating config")
-				// }
+		b = &burst{first: now}
+		w.bursts[key] = b
+	}
+	b.last = now
+	b.events++
+}
+
+// deadline returns when the mapping for key should run
+func (w *Watcher) deadline(key string, b *burst) time.Time {
+	cfg := w.config[key]
+	quiet := b.last.Add(cfg.Debounce.QuietPeriod.Duration)
+	if limit := b.first.Add(cfg.Debounce.MaxWait.Duration); limit.Before(quiet) {
+		return limit
+	}
+	return quiet
+}
+
+// nextFlush returns when the next queued mapping is due
+func (w *Watcher) nextFlush() (time.Time, bool) {
+	var next time.Time
+	for key, b := range w.bursts {
+		if d := w.deadline(key, b); next.IsZero() || d.Before(next) {
+			next = d
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// flush runs the queued mappings that are due
+func (w *Watcher) flush(ctx context.Context, now time.Time) {
+	for key, b := range w.bursts {
+		if w.deadline(key, b).After(now) {
+			continue
+		}
+		delete(w.bursts, key)
+		// refresh the watches, symlinks may point somewhere else now or the path may be gone
+		wasPending := w.isPending(key)
+		if err := w.watch(key); err != nil {
+			w.log.Err(err).Str("path", key).Msg("updating file watch")
+		}
+		if w.isPending(key) {
+			if !wasPending {
+				w.handleDelete(ctx, key)
 			}
+			continue
+		}
+		err := w.sync(ctx, key, w.config[key], true)
+		w.log.Err(err).Str("path", key).Int("events", b.events).Msg("updating config")
+	}
+}
+
+// handleDelete applies the mapping's deletion policy after its path was deleted
+func (w *Watcher) handleDelete(ctx context.Context, key string) {
+	cfg := w.config[key]
+	// make sure the mapping runs again if the path is recreated with the same content
+	delete(w.hashes, key)
+	keys := w.keys[key]
+	delete(w.keys, key)
+
+	if cfg.Name == "" {
+		return
+	}
+
+	deletions.WithLabelValues(key, cfg.OnDelete).Inc()
+	log := w.log.Info().Str("path", key).Str("policy", cfg.OnDelete)
+
+	switch cfg.OnDelete {
+	case OnDeleteRemoveKey:
+		if len(keys) == 0 {
+			keys = []string{resourceKey(key, cfg)}
 		}
-		if longestMatch == "" {
-			return fmt.Errorf("config for %s not found", path)
+		op, err := utils.RemoveKeys(ctx, cfg.ResourceMapping, owner(key), keys, w.k8s)
+		w.log.Err(err).Str("operation", string(op)).Str("path", key).Strs("keys", keys).Msgf("%s: %s/%s", cfg.ResourceType, cfg.Namespace, cfg.Name)
+	case OnDeleteDelete:
+		if cfg.Strategy == utils.StrategyMerge || cfg.Strategy == utils.StrategyApply {
+			// the resource can be shared with other mappings, only remove the keys owned by this one
+			op, err := utils.Release(ctx, cfg.ResourceMapping, owner(key), w.k8s)
+			w.log.Err(err).Str("operation", string(op)).Str("path", key).Msgf("%s: %s/%s", cfg.ResourceType, cfg.Namespace, cfg.Name)
+			break
 		}
-		return w.do(ctx, longestMatch)
+		err := utils.Delete(ctx, cfg.ResourceMapping, w.k8s)
+		w.log.Err(err).Str("operation", "deleted").Str("path", key).Msgf("%s: %s/%s", cfg.ResourceType, cfg.Namespace, cfg.Name)
+	default:
+		log = log.Str("resource", fmt.Sprintf("%s: %s/%s", cfg.ResourceType, cfg.Namespace, cfg.Name))
+	}
+
+	log.Msg("path deleted")
+}
+
+// owner returns the identifier of the mapping for key in the resources it merges into
+func owner(key string) string {
+	return utils.Owner("file", key)
+}
+
+// prune removes the keys written by file mappings that are no longer configured
+func (w *Watcher) prune(ctx context.Context) {
+	mappings := make(map[string]config.ResourceMapping, len(w.config))
+	for key, cfg := range w.config {
+		mappings[owner(key)] = cfg.ResourceMapping
+	}
+	err := utils.Prune(ctx, utils.Owner("file", ""), mappings, w.k8s)
+	w.log.Err(err).Str("operation", "prune").Msg("removing keys of deleted mappings")
+}
+
+// resourceKey returns the resource key for a single file mapping
+func resourceKey(path string, cfg config.FileMapping) string {
+	if cfg.Key != "" {
+		return cfg.Key
+	}
+	return utils.EncodeKey(filepath.Base(path))
+}
+
+// post sends payload to url, the request is canceled with ctx
+func (w *Watcher) post(ctx context.Context, url string, payload []byte) (*http.Response, error) {
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, url, payload)
+	if err != nil {
+		return nil, err
+	}
+	return w.http.Do(req)
+}
+
+// sync updates the mapped resource and URL with the contents of path
+// and, if signal is set, notifies the mapped process
+func (w *Watcher) sync(ctx context.Context, path string, cfg config.FileMapping, signal bool) error {
+	if cfg.Timeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout.Duration)
+		defer cancel()
+	}
+
+	data, err := getData(path, cfg)
+	if err != nil {
+		return err
 	}
 
-	if cfg.ProcessName != "" {
+	sum := utils.Hash(data)
+	if w.hashes[path] == sum {
+		// the content didn't change
+		w.log.Debug().Str("path", path).Msg("no changes")
+		return nil
+	}
+
+	if signal && cfg.ProcessName != "" {
 		sig := syscall.SIGHUP
 		if cfg.Signal != 0 {
 			sig = cfg.Signal
@@ -194,24 +1040,22 @@ func (w *Watcher) do(ctx context.Context, path string) error {
 
 	if cfg.Name == "" && cfg.URL == "" {
 		// nothing left to be done
+		w.hashes[path] = sum
 		return nil
 	}
 
-	data, err := getData(path)
-	if err != nil {
-		return err
-	}
-
 	// post the file contents to the configured URL
 	if cfg.URL != "" {
 		for _, payload := range data {
 			// TODO: set the bodyType from the file type? Allow templating the URL with the fileName?
-			resp, err := w.http.Post(cfg.URL, "", payload)
+			resp, err := w.post(ctx, cfg.URL, payload)
 			if resp == nil {
 				resp = &http.Response{
 					Status:     http.StatusText(http.StatusInternalServerError),
 					StatusCode: http.StatusInternalServerError,
 				}
+			} else {
+				_ = resp.Body.Close()
 			}
 			w.log.Err(err).Str("operation", "post").Str("path", path).Msgf("%s: %s", cfg.URL, resp.Status)
 		}
@@ -219,19 +1063,34 @@ func (w *Watcher) do(ctx context.Context, path string) error {
 
 	if cfg.Name == "" {
 		// nothing left to be done
+		w.hashes[path] = sum
 		return nil
 	}
 
 	if cfg.Key != "" {
-		fname := filepath.Base(path)
+		fname := utils.EncodeKey(filepath.Base(path))
 		if d, ok := data[fname]; ok && fname != cfg.Key {
 			data[cfg.Key] = d
 			delete(data, fname)
 		}
 	}
 
+	// files removed from a mapped directory are removed from the resource
+	keys := slices.Sorted(maps.Keys(data))
+	if removed := slices.DeleteFunc(slices.Clone(w.keys[path]), func(k string) bool {
+		_, ok := data[k]
+		return ok
+	}); len(removed) > 0 {
+		deletions.WithLabelValues(path, OnDeleteRemoveKey).Add(float64(len(removed)))
+		w.log.Info().Str("path", path).Strs("keys", removed).Msg("files deleted, removing keys")
+	}
+
 	// Create or update the k8s resource
-	op, err := utils.CreateOrUpdate(ctx, cfg.Name, cfg.Namespace, cfg.ResourceType, data, w.k8s)
+	op, err := utils.CreateOrUpdate(ctx, cfg.ResourceMapping, owner(path), data, w.k8s)
 	w.log.Err(err).Str("operation", string(op)).Str("path", path).Msgf("%s: %s/%s", cfg.ResourceType, cfg.Namespace, cfg.Name)
+	if err == nil {
+		w.hashes[path] = sum
+		w.keys[path] = keys
+	}
 	return err
 }
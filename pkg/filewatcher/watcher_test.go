@@ -1,13 +1,49 @@
 package filewatcher
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"sort"
 	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/luisdavim/configmapper/pkg/config"
 )
 
+func newTestWatcher(t *testing.T, cfg config.FileMap) *Watcher {
+	t.Helper()
+
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatalf("NewWatcher() error = %v", err)
+	}
+	t.Cleanup(func() { _ = fw.Close() })
+
+	return &Watcher{
+		config:  cfg,
+		fw:      fw,
+		log:     zerolog.Nop(),
+		pending: make(map[string]string),
+		bursts:  make(map[string]*burst),
+		links:   make(map[string][]string),
+		hashes:  make(map[string]string),
+		polls:   make(map[string]time.Time),
+		stats:   make(map[string]string),
+		keys:    make(map[string][]string),
+	}
+}
+
 func TestGetFilesFromPathReturnsSingleFile(t *testing.T) {
 	t.Parallel()
 
@@ -78,16 +114,344 @@ func TestGetDataReadsDirectoryFiles(t *testing.T) {
 		t.Fatalf("WriteFile() error = %v", err)
 	}
 
-	data, err := getData(dir)
+	data, err := getData(dir, config.FileMapping{})
 	if err != nil {
 		t.Fatalf("getData() error = %v", err)
 	}
 
-	want := map[string]string{
-		"config.yaml": "one",
-		"users.yaml":  "two",
+	want := map[string][]byte{
+		"config.yaml": []byte("one"),
+		"users.yaml":  []byte("two"),
 	}
 	if !reflect.DeepEqual(data, want) {
 		t.Fatalf("getData() = %v, want %v", data, want)
 	}
 }
+
+func TestInitialSyncReportsFailedPaths(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.yaml")
+	skipped := filepath.Join(dir, "skipped.yaml")
+
+	w := newTestWatcher(t, config.FileMap{
+		missing: {ResourceMapping: config.ResourceMapping{Name: "cm"}},
+		skipped: {
+			ResourceMapping: config.ResourceMapping{Name: "cm"},
+			InitialSync:     config.InitialSync{Disabled: true},
+		},
+	})
+
+	failed := w.initialSync(context.Background())
+	if _, ok := failed[missing]; !ok {
+		t.Fatalf("initialSync() = %v, want failure for %q", failed, missing)
+	}
+	if _, ok := failed[skipped]; ok {
+		t.Fatalf("initialSync() = %v, want %q to be skipped", failed, skipped)
+	}
+
+	if err := os.WriteFile(missing, []byte("hello"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	w.config[missing] = config.FileMapping{}
+	if failed := w.retrySync(context.Background(), failed); len(failed) != 0 {
+		t.Fatalf("retrySync() = %v, want no failures", failed)
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	t.Parallel()
+
+	if got := nextBackoff(DefaultRetryInterval); got != 2*DefaultRetryInterval {
+		t.Fatalf("nextBackoff() = %v, want %v", got, 2*DefaultRetryInterval)
+	}
+	if got := nextBackoff(MaxRetryInterval); got != MaxRetryInterval {
+		t.Fatalf("nextBackoff() = %v, want %v", got, MaxRetryInterval)
+	}
+}
+
+func TestWatchMissingPathWaitsForParent(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "nested", "config.yaml")
+
+	w := newTestWatcher(t, config.FileMap{missing: {}})
+
+	if err := w.watch(missing); err != nil {
+		t.Fatalf("watch() error = %v", err)
+	}
+	if got := w.pending[missing]; got != dir {
+		t.Fatalf("pending[%q] = %q, want %q", missing, got, dir)
+	}
+	if err := w.Ready(nil); err == nil {
+		t.Fatalf("Ready() error = nil, want pending paths")
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "nested"), 0o755); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+	w.resolvePending(context.Background())
+	if got := w.pending[missing]; got != filepath.Join(dir, "nested") {
+		t.Fatalf("pending[%q] = %q, want %q", missing, got, filepath.Join(dir, "nested"))
+	}
+
+	if err := os.WriteFile(missing, []byte("hello"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	w.resolvePending(context.Background())
+	if pending := w.Pending(); len(pending) != 0 {
+		t.Fatalf("Pending() = %v, want none", pending)
+	}
+	if err := w.Ready(nil); err != nil {
+		t.Fatalf("Ready() error = %v", err)
+	}
+}
+
+func TestQueueCoalescesEvents(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	w := newTestWatcher(t, config.FileMap{
+		dir: {
+			Debounce: config.Debounce{
+				QuietPeriod: metav1.Duration{Duration: time.Second},
+				MaxWait:     metav1.Duration{Duration: 3 * time.Second},
+			},
+		},
+	})
+
+	start := time.Now()
+	w.queue(filepath.Join(dir, "a.yaml"), start)
+	w.queue(filepath.Join(dir, "b.yaml"), start.Add(500*time.Millisecond))
+
+	if len(w.bursts) != 1 || w.bursts[dir].events != 2 {
+		t.Fatalf("bursts = %v, want a single burst with 2 events", w.bursts)
+	}
+	if next, _ := w.nextFlush(); !next.Equal(start.Add(1500 * time.Millisecond)) {
+		t.Fatalf("nextFlush() = %v, want %v", next, start.Add(1500*time.Millisecond))
+	}
+
+	// a continuous burst is capped by the max wait
+	w.queue(filepath.Join(dir, "a.yaml"), start.Add(2500*time.Millisecond))
+	if next, _ := w.nextFlush(); !next.Equal(start.Add(3 * time.Second)) {
+		t.Fatalf("nextFlush() = %v, want %v", next, start.Add(3*time.Second))
+	}
+
+	w.flush(context.Background(), start.Add(2*time.Second))
+	if len(w.bursts) != 1 {
+		t.Fatalf("flush() ran the mapping before its deadline")
+	}
+	w.flush(context.Background(), start.Add(3*time.Second))
+	if len(w.bursts) != 0 {
+		t.Fatalf("flush() didn't run the mapping after its deadline")
+	}
+}
+
+// newKubeletVolume lays out dir the way the kubelet projects ConfigMap volumes
+func newKubeletVolume(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	ts := filepath.Join(dir, "..2024_01_01_00_00_00.000000000")
+	if err := os.Mkdir(ts, 0o755); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(ts, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		if err := os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name)); err != nil {
+			t.Fatalf("Symlink() error = %v", err)
+		}
+	}
+	if err := os.Symlink(filepath.Base(ts), filepath.Join(dir, "..data")); err != nil {
+		t.Fatalf("Symlink() error = %v", err)
+	}
+}
+
+func TestGetDataReadsKubeletVolume(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	newKubeletVolume(t, dir, map[string]string{"config.yaml": "one", "users.yaml": "two"})
+
+	want := map[string][]byte{
+		"config.yaml": []byte("one"),
+		"users.yaml":  []byte("two"),
+	}
+	for _, recursive := range []bool{false, true} {
+		data, err := getData(dir, config.FileMapping{Recursive: recursive})
+		if err != nil {
+			t.Fatalf("getData() error = %v", err)
+		}
+		if !reflect.DeepEqual(data, want) {
+			t.Fatalf("getData(recursive: %v) = %v, want %v", recursive, data, want)
+		}
+	}
+}
+
+func TestAffectedWatchesFileThroughParent(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	newKubeletVolume(t, dir, map[string]string{"config.yaml": "one"})
+	file := filepath.Join(dir, "config.yaml")
+
+	w := newTestWatcher(t, config.FileMap{file: {}})
+	if err := w.watch(file); err != nil {
+		t.Fatalf("watch() error = %v", err)
+	}
+
+	tests := map[string]bool{
+		file:                         true,
+		filepath.Join(dir, "..data"): true,
+		filepath.Join(dir, "other"):  false,
+		file + ".swp":                false,
+	}
+	for path, want := range tests {
+		if got := slices.Contains(w.affected(path), file); got != want {
+			t.Errorf("affected(%q) contains %q = %v, want %v", path, file, got, want)
+		}
+	}
+}
+
+func TestSyncSkipsUnchangedContent(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("one"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	w := newTestWatcher(t, config.FileMap{file: {}})
+	if err := w.sync(context.Background(), file, w.config[file], false); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	sum := w.hashes[file]
+	if sum == "" {
+		t.Fatalf("sync() didn't record the content hash")
+	}
+
+	// an atomic save with the same content
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, []byte("one"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	if err := w.sync(context.Background(), file, w.config[file], false); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	if w.hashes[file] != sum {
+		t.Fatalf("sync() hash changed for the same content")
+	}
+}
+
+func TestPollDetectsChanges(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("one"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	w := newTestWatcher(t, config.FileMap{
+		file: {WatchMode: config.WatchMode{Mode: ModePoll, PollInterval: metav1.Duration{Duration: time.Second}}},
+	})
+	if err := w.watch(file); err != nil {
+		t.Fatalf("watch() error = %v", err)
+	}
+	if _, ok := w.polls[file]; !ok {
+		t.Fatalf("watch() didn't schedule a poll for %q", file)
+	}
+
+	now := time.Now()
+	poll := func(want bool) {
+		t.Helper()
+		clear(w.bursts)
+		w.poll(context.Background(), file, now)
+		if _, queued := w.bursts[file]; queued != want {
+			t.Fatalf("poll() queued = %v, want %v", queued, want)
+		}
+	}
+
+	poll(true)
+	poll(false)
+
+	if err := os.WriteFile(file, []byte("two!"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	poll(true)
+
+	if err := os.Remove(file); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	poll(false)
+	if !w.isPending(file) {
+		t.Fatalf("poll() didn't mark %q as pending", file)
+	}
+
+	if err := os.WriteFile(file, []byte("two!"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	// polled paths never get a filesystem watch
+	w.resolvePending(context.Background())
+	if watches := w.fw.WatchList(); len(watches) != 0 {
+		t.Fatalf("resolvePending() watched %v for a polled path", watches)
+	}
+	if !w.isPending(file) {
+		t.Fatalf("resolvePending() resolved the polled path %q", file)
+	}
+	poll(true)
+	if w.isPending(file) {
+		t.Fatalf("poll() didn't resolve %q", file)
+	}
+}
+
+func TestHandleDeleteAppliesPolicy(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	keep := filepath.Join(dir, "keep.yaml")
+	remove := filepath.Join(dir, "remove.yaml")
+	del := filepath.Join(dir, "delete.yaml")
+
+	objs := []client.Object{
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "shared", Namespace: "default"},
+			Data:       map[string]string{"keep.yaml": "one", "remove.yaml": "two", "other": "three"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "deleted", Namespace: "default"},
+			Data:       map[string]string{"delete.yaml": "four"},
+		},
+	}
+
+	w := newTestWatcher(t, config.FileMap{
+		keep:   {ResourceMapping: config.ResourceMapping{Name: "shared", Namespace: "default", ResourceType: "configmap"}, OnDelete: OnDeleteKeep},
+		remove: {ResourceMapping: config.ResourceMapping{Name: "shared", Namespace: "default", ResourceType: "configmap"}, OnDelete: OnDeleteRemoveKey},
+		del:    {ResourceMapping: config.ResourceMapping{Name: "deleted", Namespace: "default", ResourceType: "configmap"}, OnDelete: OnDeleteDelete},
+	})
+	w.k8s = fake.NewClientBuilder().WithObjects(objs...).Build()
+
+	ctx := context.Background()
+	for _, path := range []string{keep, remove, del} {
+		w.handleDelete(ctx, path)
+	}
+
+	cm := &corev1.ConfigMap{}
+	if err := w.k8s.Get(ctx, client.ObjectKey{Name: "shared", Namespace: "default"}, cm); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	want := map[string]string{"keep.yaml": "one", "other": "three"}
+	if !reflect.DeepEqual(cm.Data, want) {
+		t.Fatalf("ConfigMap data = %v, want %v", cm.Data, want)
+	}
+
+	err := w.k8s.Get(ctx, client.ObjectKey{Name: "deleted", Namespace: "default"}, &corev1.ConfigMap{})
+	if !apierrors.IsNotFound(err) {
+		t.Fatalf("Get() error = %v, want not found", err)
+	}
+}
@@ -3,8 +3,11 @@ package k8swatcher
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
+	"sync"
 	"syscall"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
@@ -19,6 +22,7 @@ import (
 	"github.com/luisdavim/configmapper/pkg/k8swatcher/secret"
 	"github.com/luisdavim/configmapper/pkg/utils"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/selection"
@@ -29,6 +33,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	// +kubebuilder:scaffold:imports
@@ -45,28 +50,36 @@ func init() {
 	//+kubebuilder:scaffold:scheme
 }
 
-func Start(ctx context.Context, cfg config.Watcher) error {
-	if !cfg.ConfigMaps && !cfg.Secrets {
-		// nothing to do here...
-		return nil
-	}
-
+// Start runs the ConfigMap and Secret controllers and serves the health probes,
+// readyChecks are added to the readiness probe.
+func Start(ctx context.Context, cfg config.Watcher, readyChecks map[string]healthz.Checker) error {
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&zap.Options{
 		Development: false,
 	})))
 
+	if !cfg.ConfigMaps && !cfg.Secrets {
+		// nothing to watch, only serve the probes and metrics
+		return serve(ctx, cfg.ProbeAddr, cfg.MetricsAddr, readyChecks)
+	}
+
 	// limit the tool to the local namespace by default
 	if cfg.Namespaces == "" {
 		cfg.Namespaces, _ = utils.GetInClusterNamespace()
 	}
 
+	// the metrics server is disabled with "0"
+	metricsAddr := cfg.MetricsAddr
+	if metricsAddr == "" {
+		metricsAddr = "0"
+	}
+
 	nss := strings.Split(cfg.Namespaces, ",")
 	ctrlOpts := ctrl.Options{
 		Scheme: scheme,
 		Metrics: metricsserver.Options{
-			BindAddress: ":8080",
+			BindAddress: metricsAddr,
 		},
-		HealthProbeBindAddress: ":8081",
+		HealthProbeBindAddress: cfg.ProbeAddr,
 		LeaderElection:         false,
 		LeaderElectionID:       "configmapper",
 	}
@@ -164,6 +177,12 @@ func Start(ctx context.Context, cfg config.Watcher) error {
 		setupLog.Error(err, "unable to set up ready check")
 		return fmt.Errorf("unable to set up ready check: %w", err)
 	}
+	for name, check := range readyChecks {
+		if err := mgr.AddReadyzCheck(name, check); err != nil {
+			setupLog.Error(err, "unable to set up ready check", "check", name)
+			return fmt.Errorf("unable to set up %s ready check: %w", name, err)
+		}
+	}
 
 	setupLog.Info("starting controller manager")
 	if err := mgr.Start(ctx); err != nil {
@@ -172,3 +191,56 @@ func Start(ctx context.Context, cfg config.Watcher) error {
 	}
 	return nil
 }
+
+// serve serves the health probes and metrics when the controller manager isn't running,
+// an empty address disables its listener and failing to listen on one is only logged
+// so the sidecar keeps running when the port is taken
+func serve(ctx context.Context, probeAddr, metricsAddr string, readyChecks map[string]healthz.Checker) error {
+	checks := map[string]healthz.Checker{"readyz": healthz.Ping}
+	for name, check := range readyChecks {
+		checks[name] = check
+	}
+
+	healthHandler := http.StripPrefix("/healthz", &healthz.Handler{Checks: map[string]healthz.Checker{"healthz": healthz.Ping}})
+	readyHandler := http.StripPrefix("/readyz", &healthz.Handler{Checks: checks})
+
+	probes := http.NewServeMux()
+	probes.Handle("/healthz", healthHandler)
+	probes.Handle("/healthz/", healthHandler)
+	probes.Handle("/readyz", readyHandler)
+	probes.Handle("/readyz/", readyHandler)
+
+	metrics := http.NewServeMux()
+	metrics.Handle("/metrics", promhttp.HandlerFor(ctrlmetrics.Registry, promhttp.HandlerOpts{}))
+
+	var servers []*http.Server
+	if probeAddr != "" {
+		servers = append(servers, &http.Server{Addr: probeAddr, Handler: probes})
+	}
+	if metricsAddr != "" {
+		servers = append(servers, &http.Server{Addr: metricsAddr, Handler: metrics})
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+	go func() {
+		<-ctx.Done()
+		for _, srv := range servers {
+			_ = srv.Close()
+		}
+	}()
+
+	setupLog.Info("serving health probes and metrics", "probes", probeAddr, "metrics", metricsAddr)
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				setupLog.Error(err, "problem serving health probes and metrics", "address", srv.Addr)
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
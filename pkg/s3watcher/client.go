@@ -0,0 +1,190 @@
+package s3watcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+	"github.com/luisdavim/configmapper/pkg/utils"
+)
+
+const (
+	// DefaultSessionName is the session name used when assuming a role
+	DefaultSessionName = "configmapper"
+	// credentialsTTL is how long the static credentials are cached before being read again
+	credentialsTTL = 5 * time.Minute
+)
+
+// clientSettings are the settings that identify an S3 client
+type clientSettings struct {
+	Endpoint    string
+	Region      string
+	PathStyle   bool
+	CAFile      string
+	Credentials config.S3Credentials
+	AssumeRole  config.AssumeRole
+	Namespace   string
+}
+
+func newClientSettings(cfg config.S3Mapping) clientSettings {
+	s := clientSettings{
+		Endpoint:    cfg.S3Endpoint,
+		Region:      cfg.Region,
+		PathStyle:   cfg.PathStyle,
+		CAFile:      cfg.CAFile,
+		Credentials: cfg.Credentials,
+		AssumeRole:  cfg.AssumeRole,
+	}
+	if hasStaticCredentials(cfg.Credentials) {
+		// the Secrets are read from the mapping's namespace
+		s.Namespace = cfg.Namespace
+	}
+	return s
+}
+
+// clientKey identifies the S3 client used by a mapping, mappings with the same endpoint and credentials share it
+func clientKey(cfg config.S3Mapping) string {
+	b, _ := json.Marshal(newClientSettings(cfg))
+	return string(b)
+}
+
+func hasStaticCredentials(c config.S3Credentials) bool {
+	return c.AccessKeyID != (config.ValueFrom{}) || c.SecretAccessKey != (config.ValueFrom{})
+}
+
+// validateClient checks the S3 client settings of a mapping
+func validateClient(cfg config.S3Mapping) error {
+	c := cfg.Credentials
+	if hasStaticCredentials(c) && (c.AccessKeyID == (config.ValueFrom{}) || c.SecretAccessKey == (config.ValueFrom{})) {
+		return fmt.Errorf("static credentials need both an accessKeyID and a secretAccessKey")
+	}
+	if cfg.AssumeRole.RoleARN == "" && (cfg.AssumeRole.ExternalID != "" || cfg.AssumeRole.SessionName != "") {
+		return fmt.Errorf("assumeRole needs a roleARN")
+	}
+	return nil
+}
+
+// client returns the S3 client for the mapping, creating it if needed
+func (w *S3Watcher) client(ctx context.Context, cfg config.S3Mapping) (s3API, error) {
+	key := clientKey(cfg)
+	if cli, ok := w.clients[key]; ok {
+		return cli, nil
+	}
+	cli, err := newS3Client(ctx, newClientSettings(cfg), w.k8s)
+	if err != nil {
+		return nil, err
+	}
+	if w.clients == nil {
+		w.clients = make(map[string]s3API)
+	}
+	w.clients[key] = cli
+	return cli, nil
+}
+
+// pruneClients drops the cached clients no mapping uses anymore,
+// so rotated credentials don't keep the old client alive, the caller must hold the lock
+func (w *S3Watcher) pruneClients() {
+	used := make(map[string]bool, len(w.config))
+	for _, c := range w.config {
+		used[clientKey(c)] = true
+	}
+	for key := range w.clients {
+		if !used[key] {
+			delete(w.clients, key)
+		}
+	}
+}
+
+func newS3Client(ctx context.Context, s clientSettings, c client.Client) (*s3.Client, error) {
+	// LoadDefaultConfig automatically reads AWS_ACCESS_KEY_ID,
+	// AWS_SECRET_ACCESS_KEY, and AWS_REGION from the environment.
+	var opts []func(*awsconfig.LoadOptions) error
+	if s.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(s.Region))
+	}
+	if s.CAFile != "" {
+		ca, err := os.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA bundle: %w", err)
+		}
+		opts = append(opts, awsconfig.WithCustomCABundle(bytes.NewReader(ca)))
+	}
+	if hasStaticCredentials(s.Credentials) {
+		opts = append(opts, awsconfig.WithCredentialsProvider(aws.NewCredentialsCache(&staticCredentials{
+			credentials: s.Credentials,
+			namespace:   s.Namespace,
+			k8s:         c,
+		})))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load SDK config, %w", err)
+	}
+
+	if role := s.AssumeRole; role.RoleARN != "" {
+		stsClient := sts.NewFromConfig(cfg, func(o *sts.Options) {
+			if role.STSEndpoint != "" {
+				o.BaseEndpoint = aws.String(role.STSEndpoint)
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(stsClient, role.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = DefaultSessionName
+			if role.SessionName != "" {
+				o.RoleSessionName = role.SessionName
+			}
+			if role.ExternalID != "" {
+				o.ExternalID = aws.String(role.ExternalID)
+			}
+		}))
+	}
+
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if s.Endpoint != "" {
+			o.BaseEndpoint = aws.String(s.Endpoint)
+		}
+		o.UsePathStyle = s.PathStyle
+	}), nil
+}
+
+// staticCredentials reads the credentials from files or Secrets,
+// they expire after a while so rotated credentials are picked up
+type staticCredentials struct {
+	credentials config.S3Credentials
+	namespace   string
+	k8s         client.Client
+}
+
+func (p *staticCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	id, err := utils.ReadValue(ctx, p.credentials.AccessKeyID, p.namespace, p.k8s)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to read the access key ID: %w", err)
+	}
+	secret, err := utils.ReadValue(ctx, p.credentials.SecretAccessKey, p.namespace, p.k8s)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to read the secret access key: %w", err)
+	}
+	token, err := utils.ReadValue(ctx, p.credentials.SessionToken, p.namespace, p.k8s)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to read the session token: %w", err)
+	}
+	return aws.Credentials{
+		AccessKeyID:     string(id),
+		SecretAccessKey: string(secret),
+		SessionToken:    string(token),
+		Source:          "configmapper",
+		CanExpire:       true,
+		Expires:         time.Now().Add(credentialsTTL),
+	}, nil
+}
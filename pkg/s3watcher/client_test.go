@@ -0,0 +1,163 @@
+package s3watcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+func TestClientCache(t *testing.T) {
+	t.Parallel()
+
+	w := &S3Watcher{k8s: fake.NewClientBuilder().Build()}
+	ctx := context.Background()
+
+	base := config.S3Mapping{BucketName: "one", S3Endpoint: "http://minio:9000", Region: "us-east-1", PathStyle: true}
+	other := base
+	other.BucketName = "two"
+	withRole := base
+	withRole.AssumeRole = config.AssumeRole{RoleARN: "arn:aws:iam::123456789012:role/config", ExternalID: "abc"}
+
+	a, err := w.client(ctx, base)
+	if err != nil {
+		t.Fatalf("client() error = %v", err)
+	}
+	b, err := w.client(ctx, other)
+	if err != nil {
+		t.Fatalf("client() error = %v", err)
+	}
+	c, err := w.client(ctx, withRole)
+	if err != nil {
+		t.Fatalf("client() error = %v", err)
+	}
+
+	if a != b {
+		t.Errorf("mappings with the same endpoint and credentials don't share the client")
+	}
+	if a == c {
+		t.Errorf("mappings with different credentials share the client")
+	}
+	if opts := a.(*s3.Client).Options(); !opts.UsePathStyle || opts.Region != "us-east-1" {
+		t.Errorf("client options = %+v, want path style in us-east-1", opts)
+	}
+}
+
+func TestClientEviction(t *testing.T) {
+	t.Parallel()
+
+	w := &S3Watcher{k8s: fake.NewClientBuilder().Build()}
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	keep := config.S3Mapping{BucketName: "one", Region: "us-east-1", LocalMapping: config.LocalMapping{Path: filepath.Join(dir, "one")}}
+	rotated := keep
+	rotated.BucketName = "two"
+	rotated.LocalMapping.Path = filepath.Join(dir, "two")
+	rotated.AssumeRole = config.AssumeRole{RoleARN: "arn:aws:iam::123456789012:role/old"}
+	if err := w.Update(ctx, config.S3Map{"one/": keep, "two/": rotated}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	for _, c := range w.config {
+		if _, err := w.client(ctx, c); err != nil {
+			t.Fatalf("client() error = %v", err)
+		}
+	}
+	kept, old := clientKey(w.config["one/"]), clientKey(w.config["two/"])
+
+	rotated.AssumeRole.RoleARN = "arn:aws:iam::123456789012:role/new"
+	if err := w.Update(ctx, config.S3Map{"one/": keep, "two/": rotated}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if _, ok := w.clients[old]; ok {
+		t.Errorf("Update() kept the client of the changed role")
+	}
+	if _, ok := w.clients[kept]; !ok {
+		t.Errorf("Update() evicted a client that is still used")
+	}
+
+	if err := w.Update(ctx, config.S3Map{"two/": rotated}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if err := w.Stop(ctx); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if _, ok := w.clients[kept]; ok {
+		t.Errorf("the client of the removed mapping wasn't evicted")
+	}
+}
+
+func TestStaticCredentials(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "access-key-id")
+	if err := os.WriteFile(file, []byte("AKIDEXAMPLE\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "s3", Namespace: "default"},
+		Data:       map[string][]byte{"secret": []byte("s3cr3t")},
+	}
+	p := &staticCredentials{
+		credentials: config.S3Credentials{
+			AccessKeyID:     config.ValueFrom{File: file},
+			SecretAccessKey: config.ValueFrom{Secret: config.SecretKeyRef{Name: "s3", Key: "secret"}},
+		},
+		namespace: "default",
+		k8s:       fake.NewClientBuilder().WithObjects(secret).Build(),
+	}
+
+	creds, err := p.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("Retrieve() error = %v", err)
+	}
+	if creds.AccessKeyID != "AKIDEXAMPLE" || creds.SecretAccessKey != "s3cr3t" || !creds.CanExpire {
+		t.Errorf("Retrieve() = %+v, want the credentials from the file and the Secret, expiring", creds)
+	}
+}
+
+func TestValidateClient(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		cfg     config.S3Mapping
+		wantErr bool
+	}{
+		{name: "ambient credentials"},
+		{
+			name: "static credentials",
+			cfg: config.S3Mapping{Credentials: config.S3Credentials{
+				AccessKeyID:     config.ValueFrom{File: "/etc/s3/id"},
+				SecretAccessKey: config.ValueFrom{File: "/etc/s3/secret"},
+			}},
+		},
+		{
+			name:    "missing secret access key",
+			cfg:     config.S3Mapping{Credentials: config.S3Credentials{AccessKeyID: config.ValueFrom{File: "/etc/s3/id"}}},
+			wantErr: true,
+		},
+		{
+			name:    "external ID without a role",
+			cfg:     config.S3Mapping{AssumeRole: config.AssumeRole{ExternalID: "abc"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if err := validateClient(tc.cfg); (err != nil) != tc.wantErr {
+				t.Errorf("validateClient() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
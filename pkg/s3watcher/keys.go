@@ -0,0 +1,140 @@
+package s3watcher
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+	"github.com/luisdavim/configmapper/pkg/utils"
+)
+
+const (
+	// MatchPrefix maps all the objects under the prefix
+	MatchPrefix = "prefix"
+	// MatchExact maps a single object
+	MatchExact = "exact"
+
+	// KeyNamingPath encodes the path of the objects relative to the prefix
+	KeyNamingPath = "path"
+	// KeyNamingBase uses the base name of the objects
+	KeyNamingBase = "base"
+	// KeyNamingTemplate renders the mapping's KeyTemplate
+	KeyNamingTemplate = "template"
+)
+
+// KeyTemplateData is the data available to the KeyTemplate
+type KeyTemplateData struct {
+	// Key is the object key
+	Key string
+	// Path is the object key relative to the prefix
+	Path string
+	// Base is the base name of the object
+	Base string
+}
+
+// validateKeys checks how the mapping selects and names the objects
+func validateKeys(cfg config.S3Mapping) error {
+	switch cfg.Match {
+	case "", MatchPrefix, MatchExact:
+	default:
+		return fmt.Errorf("invalid match: %s", cfg.Match)
+	}
+	switch cfg.KeyNaming {
+	case "", KeyNamingPath, KeyNamingBase:
+	case KeyNamingTemplate:
+		if cfg.KeyTemplate == "" {
+			return fmt.Errorf("no keyTemplate for the %s keyNaming", KeyNamingTemplate)
+		}
+		if _, err := template.New("key").Option("missingkey=error").Parse(cfg.KeyTemplate); err != nil {
+			return fmt.Errorf("invalid keyTemplate: %w", err)
+		}
+	default:
+		return fmt.Errorf("invalid keyNaming: %s", cfg.KeyNaming)
+	}
+	return nil
+}
+
+// selected reports whether the object with key is mapped by the mapping for prefix
+func selected(key, prefix string, cfg config.S3Mapping) bool {
+	if cfg.Match == MatchExact {
+		return key == prefix
+	}
+	if strings.HasSuffix(key, "/") {
+		// folder placeholders
+		return false
+	}
+	hasSuffix := func(suffixes []string) bool {
+		return slices.ContainsFunc(suffixes, func(s string) bool {
+			return strings.HasSuffix(key, s)
+		})
+	}
+	if len(cfg.Include) > 0 && !hasSuffix(cfg.Include) {
+		return false
+	}
+	return !hasSuffix(cfg.Exclude)
+}
+
+// dataKeys returns the key each object is stored under, it fails when two objects map to the same key
+func dataKeys(prefix string, objects []string, cfg config.S3Mapping) (map[string]string, error) {
+	var tmpl *template.Template
+	if cfg.KeyNaming == KeyNamingTemplate {
+		var err error
+		if tmpl, err = template.New("key").Option("missingkey=error").Parse(cfg.KeyTemplate); err != nil {
+			return nil, err
+		}
+	}
+
+	// sorted so the errors are stable
+	objects = slices.Sorted(slices.Values(objects))
+	keys := make(map[string]string, len(objects))
+	owners := make(map[string]string, len(objects))
+	for _, obj := range objects {
+		key, err := dataKey(prefix, obj, cfg, tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", obj, err)
+		}
+		if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+			return nil, fmt.Errorf("%s: invalid key %q: %s", obj, key, strings.Join(errs, ", "))
+		}
+		if other, ok := owners[key]; ok {
+			return nil, fmt.Errorf("%s and %s map to the same key: %s", other, obj, key)
+		}
+		owners[key] = obj
+		keys[obj] = key
+	}
+	return keys, nil
+}
+
+func dataKey(prefix, obj string, cfg config.S3Mapping, tmpl *template.Template) (string, error) {
+	if cfg.Match == MatchExact {
+		if cfg.Key != "" {
+			return cfg.Key, nil
+		}
+		return path.Base(obj), nil
+	}
+
+	// the path is relative to the "directory" of the prefix
+	rel := obj
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		rel = strings.TrimPrefix(obj, prefix[:i+1])
+	}
+
+	switch cfg.KeyNaming {
+	case KeyNamingBase:
+		return path.Base(obj), nil
+	case KeyNamingTemplate:
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, KeyTemplateData{Key: obj, Path: rel, Base: path.Base(obj)}); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	default:
+		return utils.EncodeKey(rel), nil
+	}
+}
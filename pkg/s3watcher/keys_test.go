@@ -0,0 +1,119 @@
+package s3watcher
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+func TestDataKeys(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		prefix  string
+		objects []string
+		cfg     config.S3Mapping
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "relative paths",
+			prefix:  "conf/",
+			objects: []string{"conf/a/config.yaml", "conf/b/config.yaml", "conf/app.yaml"},
+			want: map[string]string{
+				"conf/a/config.yaml": "a__config.yaml",
+				"conf/b/config.yaml": "b__config.yaml",
+				"conf/app.yaml":      "app.yaml",
+			},
+		},
+		{
+			name:    "partial prefix",
+			prefix:  "conf/app",
+			objects: []string{"conf/app.yaml", "conf/app.d/extra.yaml"},
+			want: map[string]string{
+				"conf/app.yaml":         "app.yaml",
+				"conf/app.d/extra.yaml": "app.d__extra.yaml",
+			},
+		},
+		{
+			name:    "base names collide",
+			prefix:  "conf/",
+			objects: []string{"conf/a/config.yaml", "conf/b/config.yaml"},
+			cfg:     config.S3Mapping{KeyNaming: KeyNamingBase},
+			wantErr: true,
+		},
+		{
+			name:    "template keys collide",
+			prefix:  "conf/",
+			objects: []string{"conf/a/config.yaml", "conf/b/config.yaml"},
+			cfg:     config.S3Mapping{KeyNaming: KeyNamingTemplate, KeyTemplate: "{{.Base}}"},
+			wantErr: true,
+		},
+		{
+			name:    "template",
+			prefix:  "conf/",
+			objects: []string{"conf/a/config.yaml"},
+			cfg:     config.S3Mapping{KeyNaming: KeyNamingTemplate, KeyTemplate: "app-{{.Base}}"},
+			want:    map[string]string{"conf/a/config.yaml": "app-config.yaml"},
+		},
+		{
+			name:    "invalid template key",
+			prefix:  "conf/",
+			objects: []string{"conf/a/config.yaml"},
+			cfg:     config.S3Mapping{KeyNaming: KeyNamingTemplate, KeyTemplate: "{{.Path}}"},
+			wantErr: true,
+		},
+		{
+			name:    "exact",
+			prefix:  "conf/app.yaml",
+			objects: []string{"conf/app.yaml"},
+			cfg:     config.S3Mapping{Match: MatchExact, ResourceMapping: config.ResourceMapping{Key: "config.yaml"}},
+			want:    map[string]string{"conf/app.yaml": "config.yaml"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := dataKeys(tc.prefix, tc.objects, tc.cfg)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("dataKeys() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && !maps.Equal(got, tc.want) {
+				t.Errorf("dataKeys() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSelected(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		key  string
+		cfg  config.S3Mapping
+		want bool
+	}{
+		{name: "under the prefix", key: "conf/app.yaml", want: true},
+		{name: "folder placeholder", key: "conf/a/", want: false},
+		{name: "included", key: "conf/app.yaml", cfg: config.S3Mapping{Include: []string{".yaml", ".json"}}, want: true},
+		{name: "not included", key: "conf/app.txt", cfg: config.S3Mapping{Include: []string{".yaml", ".json"}}, want: false},
+		{name: "excluded", key: "conf/app.yaml.bak", cfg: config.S3Mapping{Exclude: []string{".bak"}}, want: false},
+		{name: "exact", key: "conf/", cfg: config.S3Mapping{Match: MatchExact}, want: true},
+		{name: "not exact", key: "conf/app.yaml", cfg: config.S3Mapping{Match: MatchExact}, want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := selected(tc.key, "conf/", tc.cfg); got != tc.want {
+				t.Errorf("selected(%q) = %v, want %v", tc.key, got, tc.want)
+			}
+		})
+	}
+}
@@ -2,18 +2,22 @@ package s3watcher
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net/http"
 	"os"
-	"path/filepath"
-	"strings"
+	"reflect"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	konfig "sigs.k8s.io/controller-runtime/pkg/client/config"
 
@@ -23,48 +27,54 @@ import (
 
 const (
 	DefaultInterval = time.Minute
+	// DefaultTimeout bounds each poll of a mapping
+	DefaultTimeout = 5 * time.Minute
+	// DefaultConcurrency is how many objects are downloaded at the same time
+	DefaultConcurrency = 4
 )
 
+// s3API is the part of the S3 client used by the workers
+type s3API interface {
+	s3.ListObjectsV2APIClient
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
 type worker struct {
 	log        zerolog.Logger
-	client     *s3.Client
+	client     s3API
 	k8s        client.Client
 	stop       chan struct{}
 	bucketName string
-	interval   time.Duration
-	files      config.ResourceMap
+	// file is the prefix, or the key, mapped by cfg
+	file string
+	cfg  config.S3Mapping
+	// schedule is when the bucket is polled
+	schedule *utils.Schedule
+	running  *sync.WaitGroup
+	// done is closed when the worker stopped
+	done chan struct{}
+	// cache holds the objects last stored, it's nil until the first sync
+	cache map[string]object
+	// files are the keys last written to the mapping's path
+	files []string
 }
 
 type S3Watcher struct {
-	config  config.S3Map
-	log     zerolog.Logger
-	workers map[string]worker
+	config config.S3Map
+	log    zerolog.Logger
+	// workers holds a worker for each mapping, it's nil when the watcher isn't running
+	workers map[string]*worker
+	// clients holds the S3 clients by endpoint and credentials
+	clients map[string]s3API
 	k8s     client.Client
+	// running tracks the workers' goroutines so Stop can wait for them
+	running sync.WaitGroup
 	sync.RWMutex
 }
 
-func getConfigKey(cfg config.S3Mapping) string {
-	return filepath.Join(cfg.S3Endpoint, cfg.BucketName)
-}
-
-func newS3Client(ctx context.Context, endpoint string) (*s3.Client, error) {
-	// LoadDefaultConfig automatically reads AWS_ACCESS_KEY_ID,
-	// AWS_SECRET_ACCESS_KEY, and AWS_REGION from the environment.
-	cfg, err := awsconfig.LoadDefaultConfig(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("unable to load SDK config, %w", err)
-	}
-
-	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
-		if endpoint != "" {
-			o.BaseEndpoint = aws.String(endpoint)
-
-			// Custom S3 providers almost always need PathStyle.
-			// o.UsePathStyle = true
-		}
-	})
-
-	return client, nil
+// owner returns the identifier of the mapping for file in the resources it merges into
+func owner(bucket, file string) string {
+	return utils.Owner("s3", bucket+"/"+file)
 }
 
 func New(cfg config.S3Map) (*S3Watcher, error) {
@@ -77,148 +87,429 @@ func New(cfg config.S3Map) (*S3Watcher, error) {
 		return nil, fmt.Errorf("failed to create k8s client: %w", err)
 	}
 
-	w := &S3Watcher{
-		config: cfg,
-		log:    zerolog.New(os.Stderr).With().Timestamp().Str("name", "filewatcher").Logger().Level(zerolog.InfoLevel),
-		k8s:    c,
+	mappings, err := withDefaults(cfg)
+	if err != nil {
+		return nil, err
 	}
 
+	return &S3Watcher{
+		config: mappings,
+		log:    zerolog.New(os.Stderr).With().Timestamp().Str("name", "s3watcher").Logger().Level(zerolog.InfoLevel),
+		k8s:    c,
+	}, nil
+}
+
+// withDefaults returns a copy of cfg with the defaults set, it fails if any mapping is invalid
+func withDefaults(cfg config.S3Map) (config.S3Map, error) {
+	mappings := make(config.S3Map, len(cfg))
 	curNS, _ := utils.GetInClusterNamespace()
 	defaultEndpoint := os.Getenv("S3_ENDPOINT")
 	for file, c := range cfg {
-		if c.Name == "" {
-			return nil, fmt.Errorf("no resource name for %s", file)
+		if c.Name == "" && c.Path == "" {
+			return nil, fmt.Errorf("no resource name or path for %s", file)
 		}
 		if c.Namespace == "" {
 			c.Namespace = curNS
-			w.config[file] = c
+		}
+		if c.ResourceType == "" {
+			c.ResourceType = "configmap"
 		}
 		if c.S3Endpoint == "" {
 			c.S3Endpoint = defaultEndpoint
-			w.config[file] = c
 		}
-
 		if c.Interval.Duration == 0 {
 			c.Interval.Duration = DefaultInterval
-			w.config[file] = c
 		}
+		if c.Timeout.Duration == 0 {
+			c.Timeout.Duration = DefaultTimeout
+		}
+		if c.Match == "" {
+			c.Match = MatchPrefix
+		}
+		if c.KeyNaming == "" {
+			c.KeyNaming = KeyNamingPath
+		}
+		if c.Concurrency <= 0 {
+			c.Concurrency = DefaultConcurrency
+		}
+		if c.MaxSize == 0 && c.Name != "" {
+			c.MaxSize = utils.MaxResourceSize
+		}
+		if c.MaxSize > utils.MaxResourceSize && c.Name != "" {
+			return nil, fmt.Errorf("invalid maxSize for %s: %s %s/%s can't hold more than %d bytes", file, c.ResourceType, c.Namespace, c.Name, utils.MaxResourceSize)
+		}
+		if c.Strategy == "" {
+			c.Strategy = utils.StrategyReplace
+		}
+		if err := utils.ValidateResource(c.ResourceMapping); err != nil {
+			return nil, fmt.Errorf("invalid resource mapping for %s: %w", file, err)
+		}
+		if _, err := utils.FileMode(c.LocalMapping, c.ResourceType); err != nil {
+			return nil, fmt.Errorf("invalid local mapping for %s: %w", file, err)
+		}
+		if err := validateKeys(c); err != nil {
+			return nil, fmt.Errorf("invalid object selection for %s: %w", file, err)
+		}
+		if err := validateClient(c); err != nil {
+			return nil, fmt.Errorf("invalid S3 client config for %s: %w", file, err)
+		}
+		if _, err := utils.NewSchedule(c.Interval.Duration, c.Schedule); err != nil {
+			return nil, fmt.Errorf("invalid schedule for %s: %w", file, err)
+		}
+		mappings[file] = c
 	}
-
-	return w, nil
+	return mappings, nil
 }
 
+// Start starts a worker for each mapping that isn't running yet,
+// it can be called again after Stop
 func (w *S3Watcher) Start(ctx context.Context) error {
 	w.Lock()
 	defer w.Unlock()
 
 	if w.workers == nil {
-		w.workers = make(map[string]worker)
+		w.workers = make(map[string]*worker)
 	}
+	w.prune(ctx)
 
-	for f, c := range w.config {
-		key := getConfigKey(c)
-		wrk, ok := w.workers[key]
-		if !ok {
-			cli, err := newS3Client(ctx, c.S3Endpoint)
-			if err != nil {
-				return fmt.Errorf("failed to create S3 client: %w", err)
-			}
-			wrk = worker{
-				bucketName: c.BucketName,
-				client:     cli,
-				k8s:        w.k8s,
-				interval:   c.Interval.Duration,
-				stop:       make(chan struct{}),
-			}
+	var errs []error
+	for file, c := range w.config {
+		if _, ok := w.workers[file]; ok {
+			// already running
+			continue
 		}
-		if wrk.files == nil {
-			wrk.files = make(config.ResourceMap)
+		if err := w.start(ctx, file, c); err != nil {
+			errs = append(errs, err)
 		}
-		wrk.files[f] = c.ResourceMapping
-		w.workers[key] = wrk
 	}
+	return errors.Join(errs...)
+}
 
-	for _, wrk := range w.workers {
-		wrk.schedule(ctx)
+// Update replaces the mappings, only the workers of the mappings that were added, changed or removed
+// are started or stopped, the new workers run until ctx is done, like the ones started by Start
+func (w *S3Watcher) Update(ctx context.Context, cfg config.S3Map) error {
+	mappings, err := withDefaults(cfg)
+	if err != nil {
+		return err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	w.config = mappings
+	w.pruneClients()
+	if w.workers == nil {
+		// not running, the mappings are used on Start
+		return nil
+	}
+
+	var stopped []*worker
+	for file, wrk := range w.workers {
+		if c, ok := mappings[file]; ok && reflect.DeepEqual(c, wrk.cfg) {
+			continue
+		}
+		close(wrk.stop)
+		delete(w.workers, file)
+		stopped = append(stopped, wrk)
+	}
+	// a changed mapping must not race its previous worker
+	for _, wrk := range stopped {
+		<-wrk.done
 	}
 
+	w.prune(ctx)
+
+	var errs []error
+	for file, c := range mappings {
+		if _, ok := w.workers[file]; ok {
+			continue
+		}
+		if err := w.start(ctx, file, c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// start runs the worker for the mapping of file, the caller must hold the lock
+func (w *S3Watcher) start(ctx context.Context, file string, c config.S3Mapping) error {
+	sched, err := utils.NewSchedule(c.Interval.Duration, c.Schedule)
+	if err != nil {
+		return fmt.Errorf("invalid schedule for %s: %w", file, err)
+	}
+	cli, err := w.client(ctx, c)
+	if err != nil {
+		return fmt.Errorf("failed to create S3 client for %s: %w", file, err)
+	}
+	wrk := &worker{
+		log:        w.log.With().Str("bucket", c.BucketName).Str("prefix", file).Logger(),
+		bucketName: c.BucketName,
+		client:     cli,
+		k8s:        w.k8s,
+		file:       file,
+		cfg:        c,
+		schedule:   sched,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		running:    &w.running,
+	}
+	w.workers[file] = wrk
+	wrk.run(ctx)
 	return nil
 }
 
-func (w *S3Watcher) Stop() {
+// prune removes the keys of the deleted mappings from the resources they merged into
+func (w *S3Watcher) prune(ctx context.Context) {
+	mappings := make(map[string]config.ResourceMapping, len(w.config))
+	for f, c := range w.config {
+		mappings[owner(c.BucketName, f)] = c.ResourceMapping
+	}
+	err := utils.Prune(ctx, utils.Owner("s3", ""), mappings, w.k8s)
+	w.log.Err(err).Str("operation", "prune").Msg("removing keys of deleted mappings")
+}
+
+// Stop stops the workers and waits for the running downloads to finish,
+// it gives up waiting when ctx is done
+func (w *S3Watcher) Stop(ctx context.Context) error {
 	w.Lock()
-	defer w.Unlock()
-	for _, c := range w.config {
-		key := getConfigKey(c)
-		if wkr, ok := w.workers[key]; ok && wkr.stop != nil {
-			close(wkr.stop)
-		}
-		delete(w.workers, key)
+	for _, wrk := range w.workers {
+		close(wrk.stop)
+	}
+	w.workers = nil
+	w.pruneClients()
+	w.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for the downloads to finish: %w", ctx.Err())
 	}
 }
 
-func (w *worker) schedule(ctx context.Context) {
+func (w *worker) run(ctx context.Context) {
+	w.running.Add(1)
 	go func() {
-		err := w.download(ctx)
-		w.log.Err(err).Str("bucket", w.bucketName).Msg("downloading")
-		ticker := time.NewTicker(w.interval)
-		defer ticker.Stop()
+		defer w.running.Done()
+		defer close(w.done)
+		w.log.Info().Msg("starting")
+		timer := time.NewTimer(w.schedule.First())
+		defer timer.Stop()
 		for {
 			select {
-			case <-ticker.C:
-				err := w.download(ctx)
-				w.log.Err(err).Str("bucket", w.bucketName).Msg("downloading")
+			case <-timer.C:
+				err := w.sync(ctx, w.file, w.cfg)
+				w.log.Err(err).Msg("downloading")
+				timer.Reset(w.schedule.Next(time.Now(), err, 0))
 			case <-ctx.Done():
-				w.log.Info().Str("bucket", w.bucketName).Msg("context canceled, stopping")
+				w.log.Info().Msg("context canceled, stopping")
 				return
 			case <-w.stop:
-				w.log.Info().Str("bucket", w.bucketName).Msg("got quit signal, stopping")
+				w.log.Info().Msg("got quit signal, stopping")
 				return
 			}
 		}
 	}()
 }
 
-func (w *worker) download(ctx context.Context) error {
-	for file, cfg := range w.files {
-		output, err := w.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
-			Bucket: aws.String(w.bucketName),
-			Prefix: &file,
-		})
-		w.log.Err(err).Str("bucket", w.bucketName).Str("path", file).Msg("listing objects")
+// sync updates the resource mapped to file, bounded by the mapping's timeout
+func (w *worker) sync(ctx context.Context, file string, cfg config.S3Mapping) error {
+	if cfg.Timeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout.Duration)
+		defer cancel()
+	}
+
+	objects, err := w.list(ctx, file, cfg)
+	w.log.Err(err).Msg("listing objects")
+	if err != nil {
+		return err
+	}
+	if cfg.Match == MatchExact && len(objects) == 0 {
+		return fmt.Errorf("object %s not found", file)
+	}
+	names := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		names = append(names, aws.ToString(obj.Key))
+	}
+	keys, err := dataKeys(file, names, cfg)
+	if err != nil {
+		return err
+	}
+
+	prev, synced := w.cache, w.cache != nil
+	current, changed, err := w.fetch(ctx, file, objects, cfg, prev)
+	if err != nil {
+		return err
+	}
+	if synced && !changed {
+		w.log.Debug().Msg("no changes")
+		return nil
+	}
+
+	data := make(map[string][]byte, len(current))
+	for key, obj := range current {
+		data[keys[key]] = obj.data
+	}
+
+	if cfg.Name != "" {
+		op, err := utils.CreateOrUpdate(ctx, cfg.ResourceMapping, owner(w.bucketName, file), data, w.k8s)
+		w.log.Err(err).Str("operation", string(op)).Msgf("%s: %s/%s", cfg.ResourceType, cfg.Namespace, cfg.Name)
 		if err != nil {
-			continue
+			return err
+		}
+	}
+	if cfg.Path != "" {
+		// the mode was validated with the mapping
+		mode, _ := utils.FileMode(cfg.LocalMapping, cfg.ResourceType)
+		changed, err := utils.MirrorFiles(ctx, cfg.LocalMapping, mode, w.files, data)
+		w.log.Err(err).Str("operation", "write").Msgf("%s: %d files changed", cfg.Path, len(changed))
+		if err != nil {
+			return err
+		}
+		w.files = slices.Collect(maps.Keys(data))
+	}
+
+	// only cache the objects once they were stored, otherwise a failed update would never be retried
+	w.cache = current
+	return nil
+}
+
+// list returns all the objects under the prefix, going through all the pages of the listing,
+// it fails when the objects exceed the mapping's limits
+func (w *worker) list(ctx context.Context, prefix string, cfg config.S3Mapping) ([]types.Object, error) {
+	var (
+		objects []types.Object
+		size    int64
+	)
+	paginator := s3.NewListObjectsV2Paginator(w.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(w.bucketName),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			if !selected(aws.ToString(obj.Key), prefix, cfg) {
+				continue
+			}
+			objects = append(objects, obj)
+			size += aws.ToInt64(obj.Size)
 		}
+		if cfg.MaxObjects > 0 && len(objects) > cfg.MaxObjects {
+			return nil, fmt.Errorf("more than %d objects under %s", cfg.MaxObjects, prefix)
+		}
+		if err := checkSize(size, prefix, cfg); err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
 
-		data := map[string]string{}
+// object is the cached copy of an S3 object
+type object struct {
+	etag         string
+	lastModified time.Time
+	data         []byte
+}
+
+// fetch downloads the objects listed under prefix, at most cfg.Concurrency at a time,
+// the objects that match their cached copy in prev aren't downloaded again,
+// it reports whether any object was added, changed or removed
+func (w *worker) fetch(ctx context.Context, prefix string, objects []types.Object, cfg config.S3Mapping, prev map[string]object) (map[string]object, bool, error) {
+	var (
+		mu      sync.Mutex
+		size    int64
+		changed bool
+	)
+	result := make(map[string]object, len(objects))
+	store := func(key string, obj object, modified bool) error {
+		mu.Lock()
+		defer mu.Unlock()
+		// the objects can grow after being listed
+		size += int64(len(obj.data))
+		if err := checkSize(size, prefix, cfg); err != nil {
+			return err
+		}
+		result[key] = obj
+		changed = changed || modified
+		return nil
+	}
 
-		for _, obj := range output.Contents {
-			res, err := w.client.GetObject(ctx, &s3.GetObjectInput{
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(cfg.Concurrency, 1))
+	for _, obj := range objects {
+		key := aws.ToString(obj.Key)
+		cached, ok := prev[key]
+		if ok && cached.etag == aws.ToString(obj.ETag) && cached.lastModified.Equal(aws.ToTime(obj.LastModified)) {
+			if err := store(key, cached, false); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		g.Go(func() error {
+			input := &s3.GetObjectInput{
 				Bucket: aws.String(w.bucketName),
 				Key:    obj.Key,
-			})
-			w.log.Err(err).Str("bucket", w.bucketName).Str("path", *obj.Key).Msg("getting object")
+			}
+			if ok && cached.etag != "" {
+				input.IfNoneMatch = aws.String(cached.etag)
+			}
+			res, err := w.client.GetObject(ctx, input)
+			if ok && notModified(err) {
+				w.log.Debug().Str("path", key).Msg("not modified")
+				cached.lastModified = aws.ToTime(obj.LastModified)
+				return store(key, cached, false)
+			}
+			w.log.Err(err).Str("path", key).Msg("getting object")
 			if err != nil {
-				continue
+				return fmt.Errorf("%s: %w", key, err)
 			}
-			buf := new(strings.Builder)
-			_, err = io.Copy(buf, res.Body)
+			b, err := io.ReadAll(res.Body)
 			_ = res.Body.Close()
-			w.log.Err(err).Str("bucket", w.bucketName).Str("path", *obj.Key).Msg("reading object")
 			if err != nil {
-				continue
+				return fmt.Errorf("%s: %w", key, err)
 			}
-			data[filepath.Base(*obj.Key)] = buf.String()
-			buf.Reset()
-		}
+			return store(key, object{
+				etag:         aws.ToString(res.ETag),
+				lastModified: aws.ToTime(res.LastModified),
+				data:         b,
+			}, true)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, false, err
+	}
 
-		op, err := utils.CreateOrUpdate(ctx, cfg.Name, cfg.Namespace, cfg.ResourceType, data, w.k8s)
-		w.log.Err(err).Str("bucket", w.bucketName).Str("path", file).Str("operation", string(op)).Msgf("%s: %s/%s", cfg.ResourceType, cfg.Namespace, cfg.Name)
-		if err != nil {
-			continue
+	// objects removed from the bucket
+	for key := range prev {
+		if _, ok := result[key]; !ok {
+			changed = true
 		}
 	}
+	return result, changed, nil
+}
 
-	// TODO: collect and aggregate errors
-	return nil
+// notModified reports whether err is the response to a conditional request for an object that didn't change
+func notModified(err error) bool {
+	var re interface{ HTTPStatusCode() int }
+	return errors.As(err, &re) && re.HTTPStatusCode() == http.StatusNotModified
+}
+
+// checkSize returns an error when size exceeds the mapping's MaxSize
+func checkSize(size int64, prefix string, cfg config.S3Mapping) error {
+	if cfg.MaxSize <= 0 || size <= cfg.MaxSize {
+		return nil
+	}
+	if cfg.Name != "" && cfg.MaxSize >= utils.MaxResourceSize {
+		return fmt.Errorf("the objects under %s add up to more than %d bytes, the size limit of %s %s/%s, map fewer objects or write them to a path instead", prefix, utils.MaxResourceSize, cfg.ResourceType, cfg.Namespace, cfg.Name)
+	}
+	return fmt.Errorf("the objects under %s add up to more than the maxSize of %d bytes", prefix, cfg.MaxSize)
 }
@@ -0,0 +1,349 @@
+package s3watcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+	"github.com/luisdavim/configmapper/pkg/utils"
+)
+
+// fakeS3 serves objects from memory, listing at most pageSize objects per page
+type fakeS3 struct {
+	objects  map[string][]byte
+	pageSize int
+
+	mu sync.Mutex
+	// gets is the number of downloads and maxGets the most that ran at the same time
+	gets, inFlight, maxGets int
+}
+
+func (f *fakeS3) ListObjectsV2(_ context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, aws.ToString(in.Prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	start := 0
+	if in.ContinuationToken != nil {
+		start, _ = strconv.Atoi(*in.ContinuationToken)
+	}
+	end := min(start+f.pageSize, len(keys))
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(end < len(keys))}
+	for _, k := range keys[start:end] {
+		out.Contents = append(out.Contents, types.Object{Key: aws.String(k), ETag: aws.String(etag(f.objects[k])), Size: aws.Int64(int64(len(f.objects[k])))})
+	}
+	if end < len(keys) {
+		out.NextContinuationToken = aws.String(strconv.Itoa(end))
+	}
+	return out, nil
+}
+
+func (f *fakeS3) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	f.gets++
+	f.inFlight++
+	f.maxGets = max(f.maxGets, f.inFlight)
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.inFlight--
+		f.mu.Unlock()
+	}()
+
+	b, ok := f.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	if aws.ToString(in.IfNoneMatch) == etag(b) {
+		return nil, statusError(http.StatusNotModified)
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(b)), ETag: aws.String(etag(b))}, nil
+}
+
+func etag(b []byte) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(b)))
+}
+
+// statusError is an error response from S3
+type statusError int
+
+func (e statusError) Error() string {
+	return http.StatusText(int(e))
+}
+
+func (e statusError) HTTPStatusCode() int {
+	return int(e)
+}
+
+func newTestWorker(fs *fakeS3) *worker {
+	return &worker{
+		log:        zerolog.Nop(),
+		client:     fs,
+		k8s:        fake.NewClientBuilder().Build(),
+		bucketName: "bucket",
+	}
+}
+
+func TestSyncPaginates(t *testing.T) {
+	t.Parallel()
+
+	fs := &fakeS3{objects: map[string][]byte{}, pageSize: 1000}
+	for i := range 2500 {
+		fs.objects[fmt.Sprintf("conf/%04d.yaml", i)] = []byte("a: b")
+	}
+	w := newTestWorker(fs)
+
+	dir := t.TempDir()
+	cfg := config.S3Mapping{LocalMapping: config.LocalMapping{Path: dir}, Concurrency: 3}
+	if err := w.sync(context.Background(), "conf/", cfg); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(entries) != 2500 {
+		t.Errorf("got %d files, want 2500", len(entries))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2499.yaml")); err != nil {
+		t.Errorf("the objects in the last page weren't written: %v", err)
+	}
+	if got := fs.maxGets; got > 3 {
+		t.Errorf("got %d concurrent downloads, want at most 3", got)
+	}
+}
+
+func TestSyncLimits(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		cfg     config.S3Mapping
+		objects map[string][]byte
+		wantErr string
+	}{
+		{
+			name:    "too many objects",
+			cfg:     config.S3Mapping{LocalMapping: config.LocalMapping{Path: t.TempDir()}, MaxObjects: 1},
+			objects: map[string][]byte{"conf/a": []byte("a"), "conf/b": []byte("b")},
+			wantErr: "more than 1 objects",
+		},
+		{
+			name:    "larger than maxSize",
+			cfg:     config.S3Mapping{LocalMapping: config.LocalMapping{Path: t.TempDir()}, MaxSize: 10},
+			objects: map[string][]byte{"conf/a": bytes.Repeat([]byte("a"), 6), "conf/b": bytes.Repeat([]byte("b"), 6)},
+			wantErr: "maxSize of 10 bytes",
+		},
+		{
+			name: "larger than a ConfigMap",
+			cfg: config.S3Mapping{
+				ResourceMapping: config.ResourceMapping{ResourceType: "configmap", Namespace: "default", Name: "app"},
+				MaxSize:         1 << 20,
+			},
+			objects: map[string][]byte{"conf/a": bytes.Repeat([]byte("a"), 1<<20), "conf/b": []byte("b")},
+			wantErr: "the size limit of configmap default/app",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			fs := &fakeS3{objects: tc.objects, pageSize: 1000}
+			w := newTestWorker(fs)
+			err := w.sync(context.Background(), "conf/", tc.cfg)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("sync() error = %v, want %q", err, tc.wantErr)
+			}
+			if fs.gets != 0 {
+				t.Errorf("got %d downloads, want the listing to be rejected before downloading", fs.gets)
+			}
+		})
+	}
+}
+
+func TestSyncSkipsUnchangedObjects(t *testing.T) {
+	t.Parallel()
+
+	fs := &fakeS3{objects: map[string][]byte{"conf/a": []byte("a"), "conf/b": []byte("b")}, pageSize: 1000}
+	w := newTestWorker(fs)
+
+	ctx := context.Background()
+	cfg := config.S3Mapping{ResourceMapping: config.ResourceMapping{ResourceType: "configmap", Namespace: "default", Name: "app", Strategy: "replace"}}
+	if err := w.sync(ctx, "conf/", cfg); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+
+	// changes made to the ConfigMap are kept while the objects don't change
+	cm := &corev1.ConfigMap{}
+	key := client.ObjectKey{Name: "app", Namespace: "default"}
+	if err := w.k8s.Get(ctx, key, cm); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	cm.Data["a"] = "changed"
+	if err := w.k8s.Update(ctx, cm); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if err := w.sync(ctx, "conf/", cfg); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	if fs.gets != 2 {
+		t.Errorf("got %d downloads, want the unchanged objects to be skipped", fs.gets)
+	}
+	if err := w.k8s.Get(ctx, key, cm); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if cm.Data["a"] != "changed" {
+		t.Errorf("a = %q, want the ConfigMap left untouched", cm.Data["a"])
+	}
+
+	// only the changed object is downloaded and the removed one is dropped
+	fs.objects["conf/a"] = []byte("a2")
+	delete(fs.objects, "conf/b")
+	if err := w.sync(ctx, "conf/", cfg); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	if fs.gets != 3 {
+		t.Errorf("got %d downloads, want 3", fs.gets)
+	}
+	if err := w.k8s.Get(ctx, key, cm); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if want := map[string]string{"a": "a2"}; !maps.Equal(cm.Data, want) {
+		t.Errorf("data = %v, want %v", cm.Data, want)
+	}
+}
+
+func TestWithDefaults(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := withDefaults(config.S3Map{"a/": {BucketName: "bucket", ResourceMapping: config.ResourceMapping{Name: "app"}}})
+	if err != nil {
+		t.Fatalf("withDefaults() error = %v", err)
+	}
+	got := cfg["a/"]
+	if got.ResourceType != "configmap" {
+		t.Errorf("ResourceType = %q, want configmap", got.ResourceType)
+	}
+	if got.Strategy != utils.StrategyReplace || got.MaxSize != utils.MaxResourceSize || got.Concurrency != DefaultConcurrency {
+		t.Errorf("withDefaults() = %+v, want the default strategy, maxSize and concurrency", got)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	t.Parallel()
+
+	fs := &fakeS3{objects: map[string][]byte{"a/app": []byte("a"), "b/app": []byte("b"), "c/app": []byte("c")}, pageSize: 1000}
+	dir := t.TempDir()
+	mapping := func(name string, interval time.Duration) config.S3Mapping {
+		return config.S3Mapping{
+			BucketName:   "bucket",
+			LocalMapping: config.LocalMapping{Path: filepath.Join(dir, name)},
+			Interval:     metav1.Duration{Duration: interval},
+		}
+	}
+	cfg, err := withDefaults(config.S3Map{"a/": mapping("a", time.Minute), "b/": mapping("b", time.Hour)})
+	if err != nil {
+		t.Fatalf("withDefaults() error = %v", err)
+	}
+	w := &S3Watcher{
+		config:  cfg,
+		log:     zerolog.Nop(),
+		k8s:     fake.NewClientBuilder().Build(),
+		clients: map[string]s3API{clientKey(cfg["a/"]): fs},
+	}
+	synced := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name, "app"))
+		return err == nil
+	}
+	waitFor := func(name string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !synced(name) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s wasn't synced", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := w.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	waitFor("a")
+	waitFor("b")
+
+	// starting again doesn't restart the workers
+	a := w.workers["a/"]
+	if err := w.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if w.workers["a/"] != a || len(w.workers) != 2 {
+		t.Fatalf("Start() restarted the running workers")
+	}
+	if a.cfg.Interval.Duration != time.Minute || w.workers["b/"].cfg.Interval.Duration != time.Hour {
+		t.Errorf("the workers don't use their mapping's interval")
+	}
+
+	// only the removed and added mappings are stopped and started
+	if err := w.Update(ctx, config.S3Map{"a/": mapping("a", time.Minute), "c/": mapping("c", time.Minute)}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if w.workers["a/"] != a {
+		t.Errorf("Update() restarted an unchanged mapping")
+	}
+	if _, ok := w.workers["b/"]; ok {
+		t.Errorf("Update() didn't stop the removed mapping")
+	}
+	waitFor("c")
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer stopCancel()
+	if err := w.Stop(stopCtx); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if err := w.Stop(stopCtx); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	// it can be started again
+	if err := os.RemoveAll(filepath.Join(dir, "a")); err != nil {
+		t.Fatalf("RemoveAll() error = %v", err)
+	}
+	if err := w.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	waitFor("a")
+	if err := w.Stop(stopCtx); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+// RecordResourceEvent creates a Kubernetes Event about the Secret or ConfigMap described by res,
+// the resource doesn't need to exist
+func RecordResourceEvent(ctx context.Context, c client.Client, res config.ResourceMapping, eventType, reason, message string) error {
+	obj, err := newObject(res.Name, res.Namespace, res.ResourceType)
+	if err != nil {
+		return err
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(obj), obj); client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	kind := "ConfigMap"
+	if _, ok := obj.(*corev1.Secret); ok {
+		kind = "Secret"
+	}
+	return RecordEvent(ctx, c, obj, "v1", kind, eventType, reason, message)
+}
+
+// RecordEvent creates a Kubernetes Event about obj, kind is the kind of obj, like ConfigMap or Deployment
+func RecordEvent(ctx context.Context, c client.Client, obj client.Object, apiVersion, kind, eventType, reason, message string) error {
+	now := metav1.NewTime(time.Now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%s", obj.GetName(), rand.String(10)),
+			Namespace: obj.GetNamespace(),
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      apiVersion,
+			Kind:            kind,
+			Name:            obj.GetName(),
+			Namespace:       obj.GetNamespace(),
+			UID:             obj.GetUID(),
+			ResourceVersion: obj.GetResourceVersion(),
+		},
+		Type:                eventType,
+		Reason:              reason,
+		Message:             message,
+		Source:              corev1.EventSource{Component: ManagedBy},
+		ReportingController: ManagedBy,
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+	}
+	return c.Create(ctx, event)
+}
@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+const (
+	// DefaultFileMode is the mode of the files written to a local path
+	DefaultFileMode os.FileMode = 0o644
+	// SecretFileMode is the default mode of the files written by mappings to Secrets
+	SecretFileMode os.FileMode = 0o600
+)
+
+// FileMode returns the mode of the files written to the local path, from the mapping's octal FileMode,
+// defaulting to 0600 for mappings to Secrets and to 0644 for the rest
+func FileMode(cfg config.LocalMapping, resourceType string) (os.FileMode, error) {
+	if cfg.FileMode == "" {
+		if strings.EqualFold(resourceType, "secret") {
+			return SecretFileMode, nil
+		}
+		return DefaultFileMode, nil
+	}
+	mode, err := strconv.ParseUint(cfg.FileMode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid fileMode %q, it must be an octal permission like 0640", cfg.FileMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// WriteFiles writes each key in data to a file named after it in dir, with the given mode,
+// files are replaced atomically and only when their content changed,
+// it returns the paths of the files that were written
+func WriteFiles(dir string, mode os.FileMode, data map[string][]byte) ([]string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	var (
+		written []string
+		errs    []error
+	)
+	for key, value := range data {
+		path, err := filePath(dir, key)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		changed, err := writeFile(path, value, mode)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		if changed {
+			written = append(written, path)
+		}
+	}
+	return written, errors.Join(errs...)
+}
+
+// RemoveFiles removes the files named after keys from dir, it returns the paths of the files that were removed
+func RemoveFiles(dir string, keys []string) ([]string, error) {
+	var (
+		removed []string
+		errs    []error
+	)
+	for _, key := range keys {
+		path, err := filePath(dir, key)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		removed = append(removed, path)
+	}
+	return removed, errors.Join(errs...)
+}
+
+// MirrorFiles writes data to the mapped directory, with the given mode, removes the files of the keys in prev
+// that are no longer in data and notifies the mapped process when any of the files changed,
+// it returns the paths of the files that changed
+func MirrorFiles(ctx context.Context, cfg config.LocalMapping, mode os.FileMode, prev []string, data map[string][]byte) ([]string, error) {
+	changed, err := WriteFiles(cfg.Path, mode, data)
+	var stale []string
+	for _, key := range prev {
+		if _, ok := data[key]; !ok {
+			stale = append(stale, key)
+		}
+	}
+	removed, rmErr := RemoveFiles(cfg.Path, stale)
+	changed = append(changed, removed...)
+	if err := errors.Join(err, rmErr); err != nil || len(changed) == 0 {
+		return changed, err
+	}
+	if err := Reload(ctx, cfg.SignalMapping); err != nil {
+		return changed, fmt.Errorf("failed to reload %s: %w", cfg.ProcessName, err)
+	}
+	return changed, nil
+}
+
+// filePath returns the path of the file named after key in dir
+func filePath(dir, key string) (string, error) {
+	if key == "" || key == "." || key == ".." || strings.ContainsRune(key, os.PathSeparator) {
+		return "", fmt.Errorf("invalid file name: %q", key)
+	}
+	return filepath.Join(dir, key), nil
+}
+
+// writeFile replaces path with data by writing a temporary file in the same directory and renaming it,
+// so readers never see a partially written file, the mode of an unchanged file is still updated
+func writeFile(path string, data []byte, mode os.FileMode) (bool, error) {
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		if info, err := os.Stat(path); err == nil && info.Mode().Perm() != mode {
+			return false, os.Chmod(path, mode)
+		}
+		return false, nil
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return false, err
+	}
+	tmp := f.Name()
+	defer func() {
+		// only left behind when something failed
+		_ = os.Remove(tmp)
+	}()
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return false, err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Reload sends the mapped signal, SIGHUP by default, to the mapped process
+func Reload(ctx context.Context, m config.SignalMapping) error {
+	if m.ProcessName == "" {
+		return nil
+	}
+	sig := syscall.SIGHUP
+	if m.Signal != 0 {
+		sig = m.Signal
+	}
+	return SignalProcess(ctx, m.ProcessName, sig)
+}
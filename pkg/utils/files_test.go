@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+func TestWriteFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "config")
+	data := map[string][]byte{
+		"app.yaml": []byte("a: b"),
+		"ca.crt":   []byte("cert"),
+	}
+
+	written, err := WriteFiles(dir, DefaultFileMode, data)
+	if err != nil {
+		t.Fatalf("WriteFiles() error = %v", err)
+	}
+	slices.Sort(written)
+	if want := []string{filepath.Join(dir, "app.yaml"), filepath.Join(dir, "ca.crt")}; !slices.Equal(written, want) {
+		t.Errorf("WriteFiles() = %v, want %v", written, want)
+	}
+
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "ca.crt"), old, old); err != nil {
+		t.Fatalf("Chtimes() error = %v", err)
+	}
+
+	// only the changed file is written
+	data["app.yaml"] = []byte("a: c")
+	written, err = WriteFiles(dir, DefaultFileMode, data)
+	if err != nil {
+		t.Fatalf("WriteFiles() error = %v", err)
+	}
+	if want := []string{filepath.Join(dir, "app.yaml")}; !slices.Equal(written, want) {
+		t.Errorf("WriteFiles() = %v, want %v", written, want)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "ca.crt")); err != nil || !info.ModTime().Equal(old) {
+		t.Errorf("unchanged file was rewritten: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "app.yaml")); string(got) != "a: c" {
+		t.Errorf("app.yaml = %q, want %q", got, "a: c")
+	}
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("got %d files, want 2", len(entries))
+	}
+
+	if _, err := WriteFiles(dir, DefaultFileMode, map[string][]byte{"../escape": []byte("x")}); err == nil {
+		t.Errorf("WriteFiles() expected an error for a key with a path separator")
+	}
+}
+
+func TestMirrorFiles(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cfg := config.LocalMapping{Path: t.TempDir()}
+	if _, err := MirrorFiles(ctx, cfg, DefaultFileMode, nil, map[string][]byte{"a": []byte("1"), "b": []byte("2")}); err != nil {
+		t.Fatalf("MirrorFiles() error = %v", err)
+	}
+
+	// the files of the keys that are gone are removed
+	changed, err := MirrorFiles(ctx, cfg, DefaultFileMode, []string{"a", "b"}, map[string][]byte{"a": []byte("1")})
+	if err != nil {
+		t.Fatalf("MirrorFiles() error = %v", err)
+	}
+	if want := []string{filepath.Join(cfg.Path, "b")}; !slices.Equal(changed, want) {
+		t.Errorf("MirrorFiles() = %v, want %v", changed, want)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Path, "b")); !os.IsNotExist(err) {
+		t.Errorf("stale file wasn't removed: %v", err)
+	}
+
+	changed, err = MirrorFiles(ctx, cfg, DefaultFileMode, []string{"a"}, map[string][]byte{"a": []byte("1")})
+	if err != nil || len(changed) != 0 {
+		t.Errorf("MirrorFiles() = %v, %v, want no changes", changed, err)
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		mode         string
+		resourceType string
+		want         os.FileMode
+		wantErr      bool
+	}{
+		{resourceType: "configmap", want: DefaultFileMode},
+		{resourceType: "Secret", want: SecretFileMode},
+		{mode: "0640", resourceType: "secret", want: 0o640},
+		{mode: "644", want: 0o644},
+		{mode: "0999", wantErr: true},
+		{mode: "01777", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		got, err := FileMode(config.LocalMapping{FileMode: tc.mode}, tc.resourceType)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("FileMode(%q, %q) error = %v, wantErr %v", tc.mode, tc.resourceType, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("FileMode(%q, %q) = %o, want %o", tc.mode, tc.resourceType, got, tc.want)
+		}
+	}
+}
+
+func TestWriteFilesMode(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	if _, err := WriteFiles(dir, SecretFileMode, map[string][]byte{"token": []byte("s3cr3t")}); err != nil {
+		t.Fatalf("WriteFiles() error = %v", err)
+	}
+	checkMode := func(want os.FileMode) {
+		t.Helper()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Fatalf("mode = %v, want %v", got, want)
+		}
+	}
+	checkMode(SecretFileMode)
+
+	// the mode of an unchanged file is updated too
+	if _, err := WriteFiles(dir, 0o640, map[string][]byte{"token": []byte("s3cr3t")}); err != nil {
+		t.Fatalf("WriteFiles() error = %v", err)
+	}
+	checkMode(0o640)
+}
@@ -0,0 +1,296 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	metav1ac "k8s.io/client-go/applyconfigurations/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+const (
+	// ManagedByLabel is set on all the resources written by configmapper
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	ManagedBy      = "configmapper"
+
+	// OwnerPod sets the sidecar's Pod as the owner of the resource
+	OwnerPod = "pod"
+	// OwnerWorkload sets the workload managing the sidecar's Pod, like a Deployment or StatefulSet, as the owner of the resource
+	OwnerWorkload = "workload"
+)
+
+// TemplateData is the data available to the label and annotation templates
+type TemplateData struct {
+	// Source is the file path, URL or object the data was read from, only available to annotations
+	Source string
+	// Hash is the hash of the data written to the resource, only available to annotations
+	Hash      string
+	Name      string
+	Namespace string
+}
+
+// ValidateResource checks the write options of a resource mapping
+func ValidateResource(res config.ResourceMapping) error {
+	switch res.Strategy {
+	case "", StrategyReplace, StrategyMerge, StrategyApply:
+	default:
+		return fmt.Errorf("invalid strategy: %s", res.Strategy)
+	}
+	if res.Immutable && res.Strategy != "" && res.Strategy != StrategyReplace {
+		return fmt.Errorf("immutable resources only support the %s strategy", StrategyReplace)
+	}
+	switch res.OwnerReference {
+	case "", OwnerPod, OwnerWorkload:
+	default:
+		return fmt.Errorf("invalid ownerReference: %s", res.OwnerReference)
+	}
+	for _, values := range []map[string]string{res.Labels, res.Annotations} {
+		for k, v := range values {
+			if _, err := template.New(k).Option("missingkey=error").Parse(v); err != nil {
+				return err
+			}
+		}
+	}
+	for k, v := range res.Labels {
+		if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			return fmt.Errorf("invalid label %q: %s", k, strings.Join(errs, ", "))
+		}
+		tpl, _ := template.New(k).Parse(v)
+		// the source is a path or URL and the hash is too long, neither is a valid label value
+		for _, field := range []string{"Source", "Hash"} {
+			if usesField(tpl.Tree.Root, field) {
+				return fmt.Errorf("label %s can't use {{.%s}}, it's only available to annotations", k, field)
+			}
+		}
+	}
+	return nil
+}
+
+// usesField reports whether a template node references the given field of TemplateData
+func usesField(node parse.Node, field string) bool {
+	uses := func(nodes ...parse.Node) bool {
+		return slices.ContainsFunc(nodes, func(n parse.Node) bool { return usesField(n, field) })
+	}
+	switch n := node.(type) {
+	case *parse.ListNode:
+		return n != nil && uses(n.Nodes...)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if uses(cmd) {
+				return true
+			}
+		}
+		return false
+	case *parse.CommandNode:
+		return uses(n.Args...)
+	case *parse.ActionNode:
+		return uses(n.Pipe)
+	case *parse.FieldNode:
+		return n.Ident[0] == field
+	case *parse.VariableNode:
+		return len(n.Ident) > 1 && n.Ident[0] == "$" && n.Ident[1] == field
+	case *parse.ChainNode:
+		return uses(n.Node)
+	case *parse.IfNode:
+		return uses(n.Pipe, n.List, n.ElseList)
+	case *parse.RangeNode:
+		return uses(n.Pipe, n.List, n.ElseList)
+	case *parse.WithNode:
+		return uses(n.Pipe, n.List, n.ElseList)
+	case *parse.TemplateNode:
+		return uses(n.Pipe)
+	}
+	return false
+}
+
+// metadata holds the labels, annotations and owner references set on the generated resources
+type metadata struct {
+	labels      map[string]string
+	annotations map[string]string
+	owners      []metav1.OwnerReference
+}
+
+func newMetadata(ctx context.Context, res config.ResourceMapping, source string, data map[string][]byte, c client.Client) (metadata, error) {
+	td := TemplateData{
+		Source:    source,
+		Hash:      Hash(data),
+		Name:      res.Name,
+		Namespace: res.Namespace,
+	}
+
+	labels, err := render(res.Labels, td)
+	if err != nil {
+		return metadata{}, fmt.Errorf("invalid labels: %w", err)
+	}
+	for k, v := range labels {
+		if errs := validation.IsValidLabelValue(v); len(errs) > 0 {
+			return metadata{}, fmt.Errorf("label %s renders to an invalid value %q: %s", k, v, strings.Join(errs, ", "))
+		}
+	}
+	labels[ManagedByLabel] = ManagedBy
+
+	annotations, err := render(res.Annotations, td)
+	if err != nil {
+		return metadata{}, fmt.Errorf("invalid annotations: %w", err)
+	}
+
+	m := metadata{labels: labels, annotations: annotations}
+	if res.OwnerReference == "" {
+		return m, nil
+	}
+	ref, err := ownerReference(ctx, res.OwnerReference, c)
+	if err != nil {
+		return metadata{}, fmt.Errorf("failed to get the owner reference: %w", err)
+	}
+	if ref.namespace != res.Namespace {
+		return metadata{}, fmt.Errorf("the owner %s %s is in namespace %s, owner references can't cross namespaces", ref.Kind, ref.Name, ref.namespace)
+	}
+	m.owners = []metav1.OwnerReference{ref.OwnerReference}
+	return m, nil
+}
+
+func render(values map[string]string, td TemplateData) (map[string]string, error) {
+	out := make(map[string]string, len(values)+1)
+	var buf bytes.Buffer
+	for k, v := range values {
+		tpl, err := template.New(k).Option("missingkey=error").Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		buf.Reset()
+		if err := tpl.Execute(&buf, td); err != nil {
+			return nil, err
+		}
+		out[k] = buf.String()
+	}
+	return out, nil
+}
+
+// setOn adds the labels, annotations and owner references to obj, keeping the existing ones
+func (m metadata) setOn(obj client.Object) {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string, len(m.labels))
+	}
+	maps.Copy(labels, m.labels)
+	obj.SetLabels(labels)
+
+	if len(m.annotations) > 0 {
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string, len(m.annotations))
+		}
+		maps.Copy(annotations, m.annotations)
+		obj.SetAnnotations(annotations)
+	}
+
+	refs := obj.GetOwnerReferences()
+	for _, ref := range m.owners {
+		if !slices.ContainsFunc(refs, func(r metav1.OwnerReference) bool { return r.UID == ref.UID }) {
+			refs = append(refs, ref)
+		}
+	}
+	obj.SetOwnerReferences(refs)
+}
+
+// applyTo adds the labels, annotations and owner references to an apply configuration
+func (m metadata) applyTo(meta *metav1ac.ObjectMetaApplyConfiguration) {
+	meta.WithLabels(m.labels)
+	if len(m.annotations) > 0 {
+		meta.WithAnnotations(m.annotations)
+	}
+	for _, ref := range m.owners {
+		meta.WithOwnerReferences(metav1ac.OwnerReference().
+			WithAPIVersion(ref.APIVersion).
+			WithKind(ref.Kind).
+			WithName(ref.Name).
+			WithUID(ref.UID))
+	}
+}
+
+type ownerRef struct {
+	metav1.OwnerReference
+	namespace string
+}
+
+// owners caches the owner references, they don't change during the life of the Pod
+var owners = struct {
+	sync.Mutex
+	refs map[string]ownerRef
+}{refs: make(map[string]ownerRef)}
+
+// ownerReference returns a reference to the sidecar's Pod or to the workload managing it,
+// the Pod is found from the POD_NAME environment variable or the hostname
+func ownerReference(ctx context.Context, kind string, c client.Client) (ownerRef, error) {
+	name := os.Getenv("POD_NAME")
+	if name == "" {
+		var err error
+		if name, err = os.Hostname(); err != nil {
+			return ownerRef{}, err
+		}
+	}
+	namespace, err := GetInClusterNamespace()
+	if err != nil {
+		return ownerRef{}, err
+	}
+
+	key := kind + ":" + namespace + "/" + name
+	owners.Lock()
+	defer owners.Unlock()
+	if ref, ok := owners.refs[key]; ok {
+		return ref, nil
+	}
+
+	obj, err := getMetadata(ctx, corev1.SchemeGroupVersion.WithKind("Pod"), namespace, name, c)
+	if err != nil {
+		return ownerRef{}, err
+	}
+	ref := metav1.OwnerReference{APIVersion: "v1", Kind: "Pod", Name: obj.Name, UID: obj.UID}
+
+	if kind == OwnerWorkload {
+		// follow the controllers up to the workload, Pods are managed by ReplicaSets owned by Deployments
+		// or by Jobs owned by CronJobs
+		for controller := metav1.GetControllerOf(obj); controller != nil; controller = metav1.GetControllerOf(obj) {
+			ref = metav1.OwnerReference{APIVersion: controller.APIVersion, Kind: controller.Kind, Name: controller.Name, UID: controller.UID}
+			if ref.Kind != "ReplicaSet" && ref.Kind != "Job" {
+				break
+			}
+			gv, err := schema.ParseGroupVersion(ref.APIVersion)
+			if err != nil {
+				return ownerRef{}, err
+			}
+			if obj, err = getMetadata(ctx, gv.WithKind(ref.Kind), namespace, ref.Name, c); err != nil {
+				return ownerRef{}, err
+			}
+		}
+	}
+
+	owners.refs[key] = ownerRef{OwnerReference: ref, namespace: namespace}
+	return owners.refs[key], nil
+}
+
+func getMetadata(ctx context.Context, gvk schema.GroupVersionKind, namespace, name string, c client.Client) (*metav1.PartialObjectMetadata, error) {
+	obj := &metav1.PartialObjectMetadata{}
+	obj.SetGroupVersionKind(gvk)
+	if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, obj); err != nil {
+		return nil, fmt.Errorf("failed to get %s %s/%s: %w", gvk.Kind, namespace, name, err)
+	}
+	return obj, nil
+}
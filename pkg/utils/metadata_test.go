@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+func TestCreateOrUpdateMetadata(t *testing.T) {
+	t.Setenv("POD_NAME", "app-7d9f-x2k4")
+	t.Setenv("POD_NAMESPACE", "default")
+
+	ctx := context.Background()
+	controller := func(kind, name, uid string) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: kind, Name: name, UID: k8stypes.UID(uid), Controller: ptr.To(true)}}
+	}
+	c := fake.NewClientBuilder().WithObjects(
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", UID: "deploy-uid"}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "app-7d9f", Namespace: "default", UID: "rs-uid", OwnerReferences: controller("Deployment", "app", "deploy-uid")}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-7d9f-x2k4", Namespace: "default", UID: "pod-uid", OwnerReferences: controller("ReplicaSet", "app-7d9f", "rs-uid")}},
+	).Build()
+
+	res := config.ResourceMapping{
+		ResourceType:   "configmap",
+		Namespace:      "default",
+		Name:           "app",
+		Labels:         map[string]string{"app": "{{.Name}}"},
+		Annotations:    map[string]string{"configmapper/source": "{{.Source}}", "configmapper/hash": "{{.Hash}}"},
+		OwnerReference: OwnerWorkload,
+	}
+	if err := ValidateResource(res); err != nil {
+		t.Fatalf("ValidateResource() error = %v", err)
+	}
+
+	data := map[string][]byte{"config.yaml": []byte("a: b")}
+	if _, err := CreateOrUpdate(ctx, res, Owner("file", "/etc/app/config.yaml"), data, c); err != nil {
+		t.Fatalf("CreateOrUpdate() error = %v", err)
+	}
+
+	cm := &corev1.ConfigMap{}
+	if err := c.Get(ctx, client.ObjectKey{Name: "app", Namespace: "default"}, cm); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got := cm.Labels[ManagedByLabel]; got != ManagedBy {
+		t.Errorf("%s label = %q, want %q", ManagedByLabel, got, ManagedBy)
+	}
+	if got := cm.Labels["app"]; got != "app" {
+		t.Errorf("app label = %q, want %q", got, "app")
+	}
+	if got := cm.Annotations["configmapper/source"]; got != "/etc/app/config.yaml" {
+		t.Errorf("source annotation = %q, want %q", got, "/etc/app/config.yaml")
+	}
+	if got := cm.Annotations["configmapper/hash"]; got != Hash(data) {
+		t.Errorf("hash annotation = %q, want %q", got, Hash(data))
+	}
+	if len(cm.OwnerReferences) != 1 || cm.OwnerReferences[0].Kind != "Deployment" || cm.OwnerReferences[0].UID != "deploy-uid" {
+		t.Errorf("OwnerReferences = %v, want the Deployment", cm.OwnerReferences)
+	}
+
+	invalid := res
+	invalid.Labels = map[string]string{"app": "{{.Name}}/{{.Namespace}}"}
+	if _, err := CreateOrUpdate(ctx, invalid, Owner("file", "/etc/app/config.yaml"), data, c); err == nil {
+		t.Errorf("CreateOrUpdate() expected an error for a label rendering to an invalid value")
+	}
+
+	res.Namespace = "other"
+	if _, err := CreateOrUpdate(ctx, res, Owner("file", "/etc/app/config.yaml"), data, c); err == nil {
+		t.Errorf("CreateOrUpdate() expected an error for an owner in a different namespace")
+	}
+}
+
+func TestValidateResource(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		res     config.ResourceMapping
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "merge", res: config.ResourceMapping{Strategy: StrategyMerge, OwnerReference: OwnerPod}},
+		{name: "invalid strategy", res: config.ResourceMapping{Strategy: "patch"}, wantErr: true},
+		{name: "invalid owner", res: config.ResourceMapping{OwnerReference: "node"}, wantErr: true},
+		{name: "invalid template", res: config.ResourceMapping{Labels: map[string]string{"a": "{{.Hash"}}, wantErr: true},
+		{name: "hash label", res: config.ResourceMapping{Labels: map[string]string{"a": "{{.Hash}}"}}, wantErr: true},
+		{name: "source label in a branch", res: config.ResourceMapping{Labels: map[string]string{"a": "{{if .Name}}{{$.Source}}{{end}}"}}, wantErr: true},
+		{name: "invalid label key", res: config.ResourceMapping{Labels: map[string]string{"a b": "c"}}, wantErr: true},
+		{name: "hash annotation", res: config.ResourceMapping{Labels: map[string]string{"app": "{{.Name}}"}, Annotations: map[string]string{"a": "{{.Hash}}"}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if err := ValidateResource(tc.res); (err != nil) != tc.wantErr {
+				t.Fatalf("ValidateResource() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
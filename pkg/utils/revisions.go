@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+const (
+	// RevisionOfLabel is set on the immutable revisions with the name of the resource they belong to
+	RevisionOfLabel = "configmapper/revision-of"
+	// RevisionAnnotation is set on the resource with the name of its current revision
+	RevisionAnnotation = "configmapper/revision"
+	// PublishedAtAnnotation records when a revision was published
+	PublishedAtAnnotation = "configmapper/published-at"
+	// RevisionKey is the key holding the name of the current revision in the resource
+	RevisionKey = "revision"
+
+	// DefaultRevisions is how many revisions are kept when the mapping doesn't set it
+	DefaultRevisions = 5
+)
+
+// RevisionName returns the name of the immutable revision of the resource for data
+func RevisionName(name string, data map[string][]byte) string {
+	return revisionName(name, Hash(data))
+}
+
+// revisionName returns the name of the immutable revision of the resource for the data with the given hash
+func revisionName(name, hash string) string {
+	return name + "-" + hash[:10]
+}
+
+// publish creates an immutable revision with data, points the resource to it
+// and deletes the revisions that are no longer retained
+func publish(ctx context.Context, res config.ResourceMapping, meta metadata, data map[string][]byte, c client.Client) (ctrlutil.OperationResult, error) {
+	name := RevisionName(res.Name, data)
+	revision, err := newObject(name, res.Namespace, res.ResourceType)
+	if err != nil {
+		return ctrlutil.OperationResultNone, err
+	}
+
+	op := ctrlutil.OperationResultNone
+	if err := c.Get(ctx, client.ObjectKeyFromObject(revision), revision); apierrors.IsNotFound(err) {
+		meta.setOn(revision)
+		labels := revision.GetLabels()
+		labels[RevisionOfLabel] = res.Name
+		revision.SetLabels(labels)
+		annotations := revision.GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[PublishedAtAnnotation] = time.Now().UTC().Format(time.RFC3339Nano)
+		revision.SetAnnotations(annotations)
+		setData(revision, data)
+		switch o := revision.(type) {
+		case *corev1.Secret:
+			o.Immutable = ptr.To(true)
+		case *corev1.ConfigMap:
+			o.Immutable = ptr.To(true)
+		}
+		if err := c.Create(ctx, revision); err != nil {
+			return ctrlutil.OperationResultNone, fmt.Errorf("failed to create revision %s: %w", name, err)
+		}
+		op = ctrlutil.OperationResultCreated
+	} else if err != nil {
+		return ctrlutil.OperationResultNone, err
+	}
+
+	alias, _ := newObject(res.Name, res.Namespace, res.ResourceType)
+	aop, err := ctrlutil.CreateOrUpdate(ctx, c, alias, func() error {
+		meta.setOn(alias)
+		annotations := alias.GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[RevisionAnnotation] = name
+		alias.SetAnnotations(annotations)
+		setData(alias, map[string][]byte{RevisionKey: []byte(name)})
+		return nil
+	})
+	if err != nil {
+		return op, fmt.Errorf("failed to point %s to revision %s: %w", res.Name, name, err)
+	}
+	if op == ctrlutil.OperationResultNone {
+		op = aop
+	}
+
+	return op, pruneRevisions(ctx, res, name, c)
+}
+
+func publishedAt(obj client.Object) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, obj.GetAnnotations()[PublishedAtAnnotation])
+	if err != nil {
+		return obj.GetCreationTimestamp().Time
+	}
+	return t
+}
+
+// currentRevision returns the revision alias points to
+func currentRevision(ctx context.Context, res config.ResourceMapping, alias client.Object, c client.Client) (client.Object, error) {
+	name := alias.GetAnnotations()[RevisionAnnotation]
+	if name == "" {
+		return nil, apierrors.NewNotFound(corev1.Resource(strings.ToLower(res.ResourceType)), res.Name+"-<revision>")
+	}
+	revision, err := newObject(name, res.Namespace, res.ResourceType)
+	if err != nil {
+		return nil, err
+	}
+	return revision, c.Get(ctx, client.ObjectKeyFromObject(revision), revision)
+}
+
+// pruneRevisions deletes the oldest revisions of the resource, keeping the current one
+func pruneRevisions(ctx context.Context, res config.ResourceMapping, current string, c client.Client) error {
+	revisions, err := listRevisions(ctx, res, c)
+	if err != nil {
+		return err
+	}
+
+	keep := res.Revisions
+	if keep <= 0 {
+		keep = DefaultRevisions
+	}
+	if len(revisions) <= keep {
+		return nil
+	}
+
+	// newest first
+	slices.SortFunc(revisions, func(a, b client.Object) int {
+		return publishedAt(b).Compare(publishedAt(a))
+	})
+	var errs []error
+	for _, r := range revisions[keep:] {
+		if r.GetName() == current {
+			continue
+		}
+		if err := c.Delete(ctx, r); client.IgnoreNotFound(err) != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// listRevisions returns the immutable revisions of the resource
+func listRevisions(ctx context.Context, res config.ResourceMapping, c client.Client) ([]client.Object, error) {
+	var revisions []client.Object
+	opts := []client.ListOption{client.InNamespace(res.Namespace), client.MatchingLabels{RevisionOfLabel: res.Name}}
+	if strings.EqualFold(res.ResourceType, "secret") {
+		list := &corev1.SecretList{}
+		if err := c.List(ctx, list, opts...); err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			revisions = append(revisions, &list.Items[i])
+		}
+	} else {
+		list := &corev1.ConfigMapList{}
+		if err := c.List(ctx, list, opts...); err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			revisions = append(revisions, &list.Items[i])
+		}
+	}
+	return revisions, nil
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+func TestCreateOrUpdateImmutable(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	c := fake.NewClientBuilder().Build()
+	res := config.ResourceMapping{ResourceType: "configmap", Namespace: "default", Name: "app", Immutable: true, Revisions: 2}
+
+	var names []string
+	for _, v := range []string{"one", "two", "three"} {
+		data := map[string][]byte{"config.yaml": []byte(v)}
+		if _, err := CreateOrUpdate(ctx, res, "file:/a", data, c); err != nil {
+			t.Fatalf("CreateOrUpdate() error = %v", err)
+		}
+		names = append(names, RevisionName(res.Name, data))
+	}
+
+	alias := &corev1.ConfigMap{}
+	if err := c.Get(ctx, client.ObjectKey{Name: "app", Namespace: "default"}, alias); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got := alias.Annotations[RevisionAnnotation]; got != names[2] {
+		t.Fatalf("%s = %s, want %s", RevisionAnnotation, got, names[2])
+	}
+	if got := alias.Data[RevisionKey]; got != names[2] {
+		t.Fatalf("%s = %s, want %s", RevisionKey, got, names[2])
+	}
+
+	list := &corev1.ConfigMapList{}
+	if err := c.List(ctx, list, client.MatchingLabels{RevisionOfLabel: "app"}); err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	got := map[string]bool{}
+	for _, cm := range list.Items {
+		if cm.Immutable == nil || !*cm.Immutable {
+			t.Errorf("revision %s is not immutable", cm.Name)
+		}
+		got[cm.Name] = true
+	}
+	if len(got) != 2 || !got[names[1]] || !got[names[2]] {
+		t.Fatalf("revisions = %v, want %v", got, names[1:])
+	}
+
+	if _, err := RemoveKeys(ctx, res, "file:/a", []string{"config.yaml"}, c); err != nil {
+		t.Fatalf("RemoveKeys() error = %v", err)
+	}
+	if err := c.Get(ctx, client.ObjectKey{Name: "app", Namespace: "default"}, alias); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if want := RevisionName(res.Name, map[string][]byte{}); alias.Data[RevisionKey] != want {
+		t.Fatalf("%s = %s, want %s", RevisionKey, alias.Data[RevisionKey], want)
+	}
+
+	if err := Delete(ctx, res, c); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := c.List(ctx, list, client.MatchingLabels{RevisionOfLabel: "app"}); err != nil || len(list.Items) != 0 {
+		t.Fatalf("List() = %d revisions, %v, want none", len(list.Items), err)
+	}
+}
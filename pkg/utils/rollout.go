@@ -0,0 +1,374 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+const (
+	// RolloutOnAnnotation can be set on a workload with a comma separated list of the resources,
+	// as <name> or <kind>/<name>, that should restart it when they change
+	RolloutOnAnnotation = "configmapper/rollout-on"
+	// ChecksumAnnotation is set on the pod template with the hash of the resource that triggered the rollout
+	ChecksumAnnotation = "configmapper/checksum"
+	// RestartedByAnnotation is set on the pod template with the resource that triggered the rollout
+	RestartedByAnnotation = "configmapper/restarted-by"
+
+	// DefaultRolloutInterval is the minimum time between two rollouts of the same workload
+	DefaultRolloutInterval = 10 * time.Second
+
+	// rolloutRetryInterval is the initial delay before retrying a failed rollout
+	rolloutRetryInterval = time.Second
+	// maxRolloutRetryInterval caps the backoff between rollout retries
+	maxRolloutRetryInterval = 5 * time.Minute
+	// rolloutTimeout bounds the delayed restarts and the rollout retries
+	rolloutTimeout = 30 * time.Second
+)
+
+// workload is a Deployment, StatefulSet or DaemonSet
+type workload struct {
+	client.Object
+	kind     string
+	template *corev1.PodTemplateSpec
+}
+
+// Rollout restarts the workloads that use the resource described by res, by setting
+// the checksum annotation on their pod template, for immutable resources, the workloads using
+// one of its previous revisions are also pointed to the current one, rollouts of the same workload are
+// delayed until the rollout interval passed and coalesced, failed rollouts are retried
+// with backoff until they succeed, the resource changes again or StopRollouts is called,
+// unless they failed for lack of permissions
+func Rollout(ctx context.Context, res config.ResourceMapping, checksum string, c client.Client) error {
+	return rollout(ctx, res, checksum, c, rolloutRetryInterval)
+}
+
+func rollout(ctx context.Context, res config.ResourceMapping, checksum string, c client.Client, backoff time.Duration) error {
+	kind := "ConfigMap"
+	if strings.EqualFold(res.ResourceType, "secret") {
+		kind = "Secret"
+	}
+	interval := res.Rollout.MinInterval.Duration
+	if interval == 0 {
+		interval = DefaultRolloutInterval
+	}
+	source := strings.ToLower(kind) + "/" + res.Name
+
+	// this rollout supersedes any retry of a previous one
+	id := source + ":" + res.Namespace
+	cancelRetry(id)
+	retry := func(err error) {
+		if apierrors.IsForbidden(err) {
+			// retrying won't help until the missing permissions are granted
+			return
+		}
+		retryRollout(id, backoff, func(ctx context.Context) error {
+			return rollout(ctx, res, checksum, c, min(2*backoff, maxRolloutRetryInterval))
+		})
+	}
+
+	// workloads using an immutable revision are pointed to the current one
+	var current string
+	var revisions []string
+	if res.Immutable {
+		current = revisionName(res.Name, checksum)
+		objs, err := listRevisions(ctx, res, c)
+		if err != nil {
+			retry(err)
+			return fmt.Errorf("failed to list revisions: %w", err)
+		}
+		for _, obj := range objs {
+			if obj.GetName() != current {
+				revisions = append(revisions, obj.GetName())
+			}
+		}
+	}
+
+	workloads, err := listWorkloads(ctx, res.Namespace, c)
+	if err != nil {
+		retry(err)
+		return fmt.Errorf("failed to list workloads: %w", err)
+	}
+
+	for _, wl := range workloads {
+		if !usesResource(wl, kind, append([]string{res.Name}, revisions...)...) {
+			continue
+		}
+		key := wl.kind + ":" + wl.GetNamespace() + "/" + wl.GetName()
+		// the restart runs with ctx, or, when delayed, until StopRollouts is called
+		throttle(ctx, key, interval, func(ctx context.Context) {
+			msg := fmt.Sprintf("%s %s/%s changed, restarting", kind, res.Namespace, res.Name)
+			eventType, reason := corev1.EventTypeNormal, "RolloutTriggered"
+			if err := restart(ctx, wl, kind, source, checksum, revisions, current, c); err != nil {
+				msg = fmt.Sprintf("failed to restart after %s %s/%s changed: %v", kind, res.Namespace, res.Name, err)
+				eventType, reason = corev1.EventTypeWarning, "RolloutFailed"
+				retry(err)
+			}
+			_ = RecordEvent(ctx, c, wl.Object, "apps/v1", wl.kind, eventType, reason, msg)
+		})
+	}
+	return nil
+}
+
+// restart sets the checksum annotation on the workload's pod template and, when current is set,
+// replaces its references to the revisions with current
+func restart(ctx context.Context, wl workload, kind, source, checksum string, revisions []string, current string, c client.Client) error {
+	patch := client.MergeFrom(wl.Object.DeepCopyObject().(client.Object))
+	if current != "" {
+		repoint(wl.template, kind, revisions, current)
+	}
+	if wl.template.Annotations == nil {
+		wl.template.Annotations = make(map[string]string)
+	}
+	wl.template.Annotations[ChecksumAnnotation] = checksum
+	wl.template.Annotations[RestartedByAnnotation] = source
+	return c.Patch(ctx, wl.Object, patch)
+}
+
+func listWorkloads(ctx context.Context, namespace string, c client.Client) ([]workload, error) {
+	var workloads []workload
+
+	deployments := &appsv1.DeploymentList{}
+	if err := c.List(ctx, deployments, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	for i := range deployments.Items {
+		d := &deployments.Items[i]
+		workloads = append(workloads, workload{Object: d, kind: "Deployment", template: &d.Spec.Template})
+	}
+
+	statefulSets := &appsv1.StatefulSetList{}
+	if err := c.List(ctx, statefulSets, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	for i := range statefulSets.Items {
+		s := &statefulSets.Items[i]
+		workloads = append(workloads, workload{Object: s, kind: "StatefulSet", template: &s.Spec.Template})
+	}
+
+	daemonSets := &appsv1.DaemonSetList{}
+	if err := c.List(ctx, daemonSets, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	for i := range daemonSets.Items {
+		d := &daemonSets.Items[i]
+		workloads = append(workloads, workload{Object: d, kind: "DaemonSet", template: &d.Spec.Template})
+	}
+
+	return workloads, nil
+}
+
+// usesResource reports whether the workload references a ConfigMap or Secret with any of the names
+// through its volumes, envFrom or env, or lists it in the rollout-on annotation
+func usesResource(wl workload, kind string, names ...string) bool {
+	if v, ok := wl.GetAnnotations()[RolloutOnAnnotation]; ok {
+		for _, ref := range strings.Split(v, ",") {
+			ref = strings.TrimSpace(ref)
+			if k, n, ok := strings.Cut(ref, "/"); ok {
+				if strings.EqualFold(k, kind) && slices.Contains(names, n) {
+					return true
+				}
+				continue
+			}
+			if slices.Contains(names, ref) {
+				return true
+			}
+		}
+	}
+
+	var found bool
+	forEachRef(wl.template, kind, func(name *string) {
+		found = found || slices.Contains(names, *name)
+	})
+	return found
+}
+
+// repoint replaces the references to the old ConfigMaps or Secrets in the pod template with name
+func repoint(template *corev1.PodTemplateSpec, kind string, old []string, name string) {
+	forEachRef(template, kind, func(ref *string) {
+		if slices.Contains(old, *ref) {
+			*ref = name
+		}
+	})
+}
+
+// forEachRef calls fn with the name of each ConfigMap or Secret referenced by the pod template's volumes, envFrom or env
+func forEachRef(template *corev1.PodTemplateSpec, kind string, fn func(name *string)) {
+	spec := &template.Spec
+	isSecret := kind == "Secret"
+	for i := range spec.Volumes {
+		v := &spec.Volumes[i]
+		switch {
+		case !isSecret && v.ConfigMap != nil:
+			fn(&v.ConfigMap.Name)
+		case isSecret && v.Secret != nil:
+			fn(&v.Secret.SecretName)
+		case v.Projected != nil:
+			for j := range v.Projected.Sources {
+				s := &v.Projected.Sources[j]
+				if isSecret && s.Secret != nil {
+					fn(&s.Secret.Name)
+				} else if !isSecret && s.ConfigMap != nil {
+					fn(&s.ConfigMap.Name)
+				}
+			}
+		}
+	}
+
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for i := range containers {
+			ctr := &containers[i]
+			for j := range ctr.EnvFrom {
+				e := &ctr.EnvFrom[j]
+				if !isSecret && e.ConfigMapRef != nil {
+					fn(&e.ConfigMapRef.Name)
+				} else if isSecret && e.SecretRef != nil {
+					fn(&e.SecretRef.Name)
+				}
+			}
+			for j := range ctr.Env {
+				e := &ctr.Env[j]
+				if e.ValueFrom == nil {
+					continue
+				}
+				if !isSecret && e.ValueFrom.ConfigMapKeyRef != nil {
+					fn(&e.ValueFrom.ConfigMapKeyRef.Name)
+				} else if isSecret && e.ValueFrom.SecretKeyRef != nil {
+					fn(&e.ValueFrom.SecretKeyRef.Name)
+				}
+			}
+		}
+	}
+}
+
+// rollouts keeps track of when each workload was last restarted, of the delayed restarts
+// and of the failed rollouts being retried, ctx is canceled by StopRollouts
+var rollouts = func() *rolloutState {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &rolloutState{
+		ctx:     ctx,
+		cancel:  cancel,
+		last:    make(map[string]time.Time),
+		pending: make(map[string]*delayedRestart),
+		retries: make(map[string]*time.Timer),
+	}
+}()
+
+type rolloutState struct {
+	sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	last    map[string]time.Time
+	pending map[string]*delayedRestart
+	retries map[string]*time.Timer
+}
+
+type delayedRestart struct {
+	timer *time.Timer
+	fn    func(context.Context)
+}
+
+// StopRollouts cancels the delayed restarts and the retries of failed rollouts,
+// no rollout is delayed or retried after it's called
+func StopRollouts() {
+	rollouts.Lock()
+	defer rollouts.Unlock()
+	rollouts.cancel()
+	for key, d := range rollouts.pending {
+		d.timer.Stop()
+		delete(rollouts.pending, key)
+	}
+	for id, t := range rollouts.retries {
+		t.Stop()
+		delete(rollouts.retries, id)
+	}
+}
+
+// throttle runs fn now, with ctx, or once interval passed since the last run for key,
+// if it's called again while waiting, only the latest fn runs
+func throttle(ctx context.Context, key string, interval time.Duration, fn func(context.Context)) {
+	rollouts.Lock()
+	if rollouts.ctx.Err() != nil {
+		rollouts.Unlock()
+		return
+	}
+	if d, waiting := rollouts.pending[key]; waiting {
+		d.fn = fn
+		rollouts.Unlock()
+		return
+	}
+
+	wait := time.Until(rollouts.last[key].Add(interval))
+	if wait <= 0 {
+		rollouts.last[key] = time.Now()
+		rollouts.Unlock()
+		fn(ctx)
+		return
+	}
+
+	d := &delayedRestart{fn: fn}
+	d.timer = time.AfterFunc(wait, func() {
+		rollouts.Lock()
+		if rollouts.pending[key] != d {
+			// stopped
+			rollouts.Unlock()
+			return
+		}
+		delete(rollouts.pending, key)
+		rollouts.last[key] = time.Now()
+		f, ctx := d.fn, rollouts.ctx
+		rollouts.Unlock()
+		ctx, cancel := context.WithTimeout(ctx, rolloutTimeout)
+		defer cancel()
+		f(ctx)
+	})
+	rollouts.pending[key] = d
+	rollouts.Unlock()
+}
+
+// retryRollout runs fn after backoff, unless it's canceled before
+func retryRollout(id string, backoff time.Duration, fn func(context.Context) error) {
+	rollouts.Lock()
+	defer rollouts.Unlock()
+	if rollouts.ctx.Err() != nil {
+		return
+	}
+	if t, ok := rollouts.retries[id]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(backoff, func() {
+		rollouts.Lock()
+		if rollouts.retries[id] != t {
+			// canceled
+			rollouts.Unlock()
+			return
+		}
+		delete(rollouts.retries, id)
+		ctx, cancel := context.WithTimeout(rollouts.ctx, rolloutTimeout)
+		rollouts.Unlock()
+		defer cancel()
+		_ = fn(ctx)
+	})
+	rollouts.retries[id] = t
+}
+
+// cancelRetry stops the pending retry of the rollout with the given id
+func cancelRetry(id string) {
+	rollouts.Lock()
+	defer rollouts.Unlock()
+	if t, ok := rollouts.retries[id]; ok {
+		t.Stop()
+		delete(rollouts.retries, id)
+	}
+}
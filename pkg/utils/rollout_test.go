@@ -0,0 +1,270 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+func TestUsesResource(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		spec        corev1.PodSpec
+		kind        string
+		want        bool
+	}{
+		{
+			name: "configmap volume",
+			spec: corev1.PodSpec{Volumes: []corev1.Volume{{VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}}}}}},
+			kind: "ConfigMap",
+			want: true,
+		},
+		{
+			name: "secret with the same name as a configmap volume",
+			spec: corev1.PodSpec{Volumes: []corev1.Volume{{VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}}}}}},
+			kind: "Secret",
+			want: false,
+		},
+		{
+			name: "projected secret",
+			spec: corev1.PodSpec{Volumes: []corev1.Volume{{VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{Sources: []corev1.VolumeProjection{{Secret: &corev1.SecretProjection{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}}}}}}}}},
+			kind: "Secret",
+			want: true,
+		},
+		{
+			name: "init container envFrom",
+			spec: corev1.PodSpec{InitContainers: []corev1.Container{{EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}}}}}}},
+			kind: "ConfigMap",
+			want: true,
+		},
+		{
+			name: "env key ref",
+			spec: corev1.PodSpec{Containers: []corev1.Container{{Env: []corev1.EnvVar{{Name: "A", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}}}}}}}},
+			kind: "Secret",
+			want: true,
+		},
+		{
+			name:        "annotation",
+			annotations: map[string]string{RolloutOnAnnotation: "other, configmap/app"},
+			kind:        "ConfigMap",
+			want:        true,
+		},
+		{
+			name:        "annotation for another kind",
+			annotations: map[string]string{RolloutOnAnnotation: "secret/app"},
+			kind:        "ConfigMap",
+			want:        false,
+		},
+		{
+			name: "unrelated",
+			spec: corev1.PodSpec{Volumes: []corev1.Volume{{VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "other"}}}}}},
+			kind: "ConfigMap",
+			want: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			d := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Annotations: tc.annotations}}
+			d.Spec.Template.Spec = tc.spec
+			if got := usesResource(workload{Object: d, kind: "Deployment", template: &d.Spec.Template}, tc.kind, "app"); got != tc.want {
+				t.Fatalf("usesResource() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCreateOrUpdateRollout(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "rollout"}}
+	deployment.Spec.Template.Spec.Volumes = []corev1.Volume{{VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}}}}}
+	unrelated := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "rollout"}}
+	c := fake.NewClientBuilder().WithObjects(deployment, unrelated).Build()
+
+	res := config.ResourceMapping{ResourceType: "configmap", Namespace: "rollout", Name: "app", Rollout: config.Rollout{Enabled: true}}
+	for _, v := range []string{"one", "two"} {
+		if _, err := CreateOrUpdate(ctx, res, "file:/a", map[string][]byte{"a": []byte(v)}, c); err != nil {
+			t.Fatalf("CreateOrUpdate() error = %v", err)
+		}
+	}
+
+	if err := c.Get(ctx, client.ObjectKeyFromObject(deployment), deployment); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	want := Hash(map[string][]byte{"a": []byte("two")})
+	if got := deployment.Spec.Template.Annotations[ChecksumAnnotation]; got != want {
+		t.Errorf("%s = %q, want %q", ChecksumAnnotation, got, want)
+	}
+	if got := deployment.Spec.Template.Annotations[RestartedByAnnotation]; got != "configmap/app" {
+		t.Errorf("%s = %q, want %q", RestartedByAnnotation, got, "configmap/app")
+	}
+
+	if err := c.Get(ctx, client.ObjectKeyFromObject(unrelated), unrelated); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if _, ok := unrelated.Spec.Template.Annotations[ChecksumAnnotation]; ok {
+		t.Errorf("unrelated workload was restarted")
+	}
+
+	events := &corev1.EventList{}
+	if err := c.List(ctx, events, client.InNamespace("rollout")); err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(events.Items) != 1 || events.Items[0].Reason != "RolloutTriggered" || events.Items[0].InvolvedObject.Name != "web" {
+		t.Fatalf("events = %v, want one RolloutTriggered event for web", events.Items)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	t.Parallel()
+
+	var calls, last atomic.Int32
+	ctx := context.Background()
+	run := func(n int32) func(context.Context) {
+		return func(context.Context) {
+			calls.Add(1)
+			last.Store(n)
+		}
+	}
+
+	throttle(ctx, "test", 50*time.Millisecond, run(1))
+	throttle(ctx, "test", 50*time.Millisecond, run(2))
+	throttle(ctx, "test", 50*time.Millisecond, run(3))
+	if calls.Load() != 1 {
+		t.Fatalf("throttle() ran %d times before the interval, want 1", calls.Load())
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if calls.Load() != 2 || last.Load() != 3 {
+		t.Fatalf("throttle() ran %d times, last %d, want 2 times, last 3", calls.Load(), last.Load())
+	}
+}
+
+func TestCreateOrUpdateRolloutRetry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "retry"}}
+	deployment.Spec.Template.Spec.Volumes = []corev1.Volume{{VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}}}}}
+	var failures atomic.Int32
+	failures.Store(1)
+	c := fake.NewClientBuilder().WithObjects(deployment).WithInterceptorFuncs(interceptor.Funcs{
+		List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+			if _, ok := list.(*appsv1.DeploymentList); ok && failures.Add(-1) >= 0 {
+				return errors.New("list failed")
+			}
+			return c.List(ctx, list, opts...)
+		},
+	}).Build()
+
+	res := config.ResourceMapping{ResourceType: "configmap", Namespace: "retry", Name: "app", Rollout: config.Rollout{Enabled: true}}
+	if _, err := CreateOrUpdate(ctx, res, "file:/a", map[string][]byte{"a": []byte("one")}, c); err != nil {
+		t.Fatalf("CreateOrUpdate() error = %v", err)
+	}
+	if _, err := CreateOrUpdate(ctx, res, "file:/a", map[string][]byte{"a": []byte("two")}, c); err == nil {
+		t.Fatalf("CreateOrUpdate() expected the rollout to fail")
+	}
+
+	// the failed rollout is retried even though the data doesn't change again
+	want := Hash(map[string][]byte{"a": []byte("two")})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := c.Get(ctx, client.ObjectKeyFromObject(deployment), deployment); err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if deployment.Spec.Template.Annotations[ChecksumAnnotation] == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the failed rollout wasn't retried")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestCreateOrUpdateRolloutImmutable(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	res := config.ResourceMapping{ResourceType: "configmap", Namespace: "immutable", Name: "app", Immutable: true, Rollout: config.Rollout{Enabled: true}}
+	one := map[string][]byte{"a": []byte("one")}
+	two := map[string][]byte{"a": []byte("two")}
+
+	mount := func(name string) []corev1.Volume {
+		return []corev1.Volume{{VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: name}}}}}
+	}
+	pinned := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "pinned", Namespace: "immutable"}}
+	pinned.Spec.Template.Spec.Volumes = mount(RevisionName(res.Name, one))
+	alias := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "alias", Namespace: "immutable"}}
+	alias.Spec.Template.Spec.Volumes = mount(res.Name)
+	c := fake.NewClientBuilder().WithObjects(pinned, alias).Build()
+
+	for _, data := range []map[string][]byte{one, two} {
+		if _, err := CreateOrUpdate(ctx, res, "file:/a", data, c); err != nil {
+			t.Fatalf("CreateOrUpdate() error = %v", err)
+		}
+	}
+
+	// the workload using the previous revision is pointed to the new one
+	if err := c.Get(ctx, client.ObjectKeyFromObject(pinned), pinned); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got, want := pinned.Spec.Template.Spec.Volumes[0].ConfigMap.Name, RevisionName(res.Name, two); got != want {
+		t.Errorf("pinned volume = %q, want %q", got, want)
+	}
+	if got, want := pinned.Spec.Template.Annotations[ChecksumAnnotation], Hash(two); got != want {
+		t.Errorf("pinned %s = %q, want %q", ChecksumAnnotation, got, want)
+	}
+
+	// the workload using the resource itself is restarted
+	if err := c.Get(ctx, client.ObjectKeyFromObject(alias), alias); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got := alias.Spec.Template.Spec.Volumes[0].ConfigMap.Name; got != res.Name {
+		t.Errorf("alias volume = %q, want %q", got, res.Name)
+	}
+	if _, ok := alias.Spec.Template.Annotations[ChecksumAnnotation]; !ok {
+		t.Errorf("the workload using the resource wasn't restarted")
+	}
+}
+
+func TestRolloutForbiddenIsNotRetried(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	c := fake.NewClientBuilder().WithInterceptorFuncs(interceptor.Funcs{
+		List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+			return apierrors.NewForbidden(appsv1.Resource("deployments"), "", errors.New("no RBAC"))
+		},
+	}).Build()
+
+	res := config.ResourceMapping{ResourceType: "configmap", Namespace: "forbidden", Name: "app", Rollout: config.Rollout{Enabled: true}}
+	if err := Rollout(ctx, res, Hash(map[string][]byte{"a": []byte("one")}), c); err == nil {
+		t.Fatalf("Rollout() expected an error without permissions")
+	}
+	rollouts.Lock()
+	_, retrying := rollouts.retries["configmap/app:forbidden"]
+	rollouts.Unlock()
+	if retrying {
+		t.Errorf("Rollout() scheduled a retry for a forbidden request")
+	}
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+// DefaultBackoffMax is the longest delay after consecutive failures
+const DefaultBackoffMax = 10 * time.Minute
+
+// Schedule computes when a source is polled next,
+// it keeps track of the consecutive failures so it must not be shared between sources
+type Schedule struct {
+	interval    time.Duration
+	cron        cron.Schedule
+	jitter      time.Duration
+	minInterval time.Duration
+	backoff     time.Duration
+	backoffMax  time.Duration
+	failures    int
+}
+
+// NewSchedule returns the schedule of a source polled every interval, or on the cron expression set in cfg
+func NewSchedule(interval time.Duration, cfg config.Schedule) (*Schedule, error) {
+	s := &Schedule{
+		interval:    interval,
+		jitter:      cfg.Jitter.Duration,
+		minInterval: cfg.MinInterval.Duration,
+		backoff:     cfg.Backoff.Initial.Duration,
+		backoffMax:  cfg.Backoff.Max.Duration,
+	}
+	if cfg.Cron != "" {
+		sched, err := cron.ParseStandard(cfg.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", cfg.Cron, err)
+		}
+		s.cron = sched
+	}
+	if s.backoffMax == 0 {
+		s.backoffMax = DefaultBackoffMax
+	}
+	if s.jitter < 0 || s.minInterval < 0 || s.backoff < 0 || s.backoffMax < 0 {
+		return nil, fmt.Errorf("negative durations are not allowed")
+	}
+	return s, nil
+}
+
+// First returns how long to wait before the first poll
+func (s *Schedule) First() time.Duration {
+	return s.withJitter(0)
+}
+
+// Next returns how long to wait, from now, before polling again after a poll that returned err,
+// the wait is never shorter than hint, the time the source asked to wait
+func (s *Schedule) Next(now time.Time, err error, hint time.Duration) time.Duration {
+	if err != nil {
+		s.failures++
+	} else {
+		s.failures = 0
+	}
+
+	wait := s.interval
+	if s.cron != nil {
+		wait = s.cron.Next(now).Sub(now)
+	}
+	wait = max(wait, hint, s.backoffDelay())
+	return max(s.withJitter(wait), s.minInterval)
+}
+
+// backoffDelay returns the delay after the current number of consecutive failures
+func (s *Schedule) backoffDelay() time.Duration {
+	if s.backoff == 0 || s.failures == 0 {
+		return 0
+	}
+	delay := s.backoff
+	for i := 1; i < s.failures && delay < s.backoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, s.backoffMax)
+}
+
+func (s *Schedule) withJitter(d time.Duration) time.Duration {
+	if s.jitter <= 0 {
+		return d
+	}
+	return d + rand.N(s.jitter)
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/luisdavim/configmapper/pkg/config"
+)
+
+func TestScheduleNext(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 1, 1, 10, 7, 0, 0, time.UTC)
+	failed := errors.New("failed")
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		cfg      config.Schedule
+		hint     time.Duration
+		errs     []error
+		want     time.Duration
+	}{
+		{
+			name:     "interval",
+			interval: time.Minute,
+			errs:     []error{nil},
+			want:     time.Minute,
+		},
+		{
+			name:     "server hint",
+			interval: time.Minute,
+			hint:     2 * time.Minute,
+			errs:     []error{nil},
+			want:     2 * time.Minute,
+		},
+		{
+			name:     "cron",
+			interval: time.Minute,
+			cfg:      config.Schedule{Cron: "*/15 * * * *"},
+			errs:     []error{nil},
+			want:     8 * time.Minute,
+		},
+		{
+			name:     "backoff",
+			interval: time.Minute,
+			cfg:      config.Schedule{Backoff: config.Backoff{Initial: metav1.Duration{Duration: time.Minute}}},
+			errs:     []error{failed, failed, failed},
+			want:     4 * time.Minute,
+		},
+		{
+			name:     "backoff is capped",
+			interval: time.Minute,
+			cfg: config.Schedule{Backoff: config.Backoff{
+				Initial: metav1.Duration{Duration: time.Minute},
+				Max:     metav1.Duration{Duration: 3 * time.Minute},
+			}},
+			errs: []error{failed, failed, failed, failed},
+			want: 3 * time.Minute,
+		},
+		{
+			name:     "backoff is reset on success",
+			interval: time.Minute,
+			cfg:      config.Schedule{Backoff: config.Backoff{Initial: metav1.Duration{Duration: 5 * time.Minute}}},
+			errs:     []error{failed, failed, nil},
+			want:     time.Minute,
+		},
+		{
+			name:     "min interval",
+			interval: time.Second,
+			cfg:      config.Schedule{Cron: "@every 1s", MinInterval: metav1.Duration{Duration: 30 * time.Second}},
+			errs:     []error{nil},
+			want:     30 * time.Second,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := NewSchedule(tc.interval, tc.cfg)
+			if err != nil {
+				t.Fatalf("NewSchedule() error = %v", err)
+			}
+			var got time.Duration
+			for _, err := range tc.errs {
+				got = s.Next(now, err, tc.hint)
+			}
+			if got != tc.want {
+				t.Errorf("Next() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestScheduleJitter(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewSchedule(time.Minute, config.Schedule{Jitter: metav1.Duration{Duration: 10 * time.Second}})
+	if err != nil {
+		t.Fatalf("NewSchedule() error = %v", err)
+	}
+	for range 100 {
+		if got := s.First(); got < 0 || got >= 10*time.Second {
+			t.Fatalf("First() = %s, want less than the jitter", got)
+		}
+		if got := s.Next(time.Now(), nil, 0); got < time.Minute || got >= time.Minute+10*time.Second {
+			t.Fatalf("Next() = %s, want the interval plus less than the jitter", got)
+		}
+	}
+}
+
+func TestNewScheduleInvalidCron(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewSchedule(time.Minute, config.Schedule{Cron: "every minute"}); err == nil {
+		t.Fatalf("NewSchedule() expected an error")
+	}
+}
@@ -3,19 +3,34 @@ package utils
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"syscall"
+	"unicode/utf8"
 
 	ps "github.com/shirou/gopsutil/v4/process"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	metav1ac "k8s.io/client-go/applyconfigurations/meta/v1"
+	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	ctrlutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/luisdavim/configmapper/pkg/config"
 )
 
 var ErrNotInK8s = errors.New("not running in-cluster, please specify the namespace")
@@ -45,29 +60,527 @@ func GetInClusterNamespace() (string, error) {
 	return strings.TrimSpace(string(namespace)), nil
 }
 
-func CreateOrUpdate(ctx context.Context, name, namespace, kind string, data map[string]string, c client.Client) (ctrlutil.OperationResult, error) {
-	if strings.EqualFold(kind, "secret") {
-		obj := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
-		op, err := ctrlutil.CreateOrUpdate(ctx, c, obj, func() error {
-			obj.StringData = data
-			return nil
-		})
+const (
+	// StrategyReplace overwrites all the data in the resource
+	StrategyReplace = "replace"
+	// StrategyMerge only writes the keys owned by the mapping, leaving the other keys untouched
+	StrategyMerge = "merge"
+	// StrategyApply writes the data with server-side apply, the keys are owned by the mapping's field manager
+	StrategyApply = "apply"
+
+	// DefaultFieldManager prefixes the field manager used for server-side apply when the mapping doesn't set one,
+	// each mapping gets its own, configmapper/<hash of the owner>, so mappings sharing a resource don't remove each other's keys
+	DefaultFieldManager = "configmapper"
+
+	// ManagedKeysAnnotation records which keys are owned by each mapping that merges into a resource
+	ManagedKeysAnnotation = "configmapper/managed-keys"
+
+	// MaxResourceSize is the maximum size of the data in a ConfigMap or Secret
+	MaxResourceSize = 1 << 20
+)
 
+// KeyPathSeparator replaces the path separators when encoding relative paths as ConfigMap keys
+const KeyPathSeparator = "__"
+
+var invalidKeyChars = regexp.MustCompile(`[^-._a-zA-Z0-9]`)
+
+// EncodeKey turns rel, a relative path, into a valid ConfigMap key
+func EncodeKey(rel string) string {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := range parts {
+		parts[i] = invalidKeyChars.ReplaceAllString(parts[i], "-")
+	}
+	return strings.Join(parts, KeyPathSeparator)
+}
+
+// Owner returns the identifier used to track the keys written by a mapping,
+// source is the type of the mapping and id the path, URL or object it reads from
+func Owner(source, id string) string {
+	return source + ":" + id
+}
+
+// CreateOrUpdate writes data to the Secret or ConfigMap described by res,
+// when merging, only the keys previously written by owner are replaced,
+// values that aren't valid UTF-8 are stored in the ConfigMap's binaryData
+func CreateOrUpdate(ctx context.Context, res config.ResourceMapping, owner string, data map[string][]byte, c client.Client) (ctrlutil.OperationResult, error) {
+	op, err := write(ctx, res, owner, data, c)
+	if err != nil || !res.Rollout.Enabled {
 		return op, err
 	}
+	// a new immutable revision changes what the resource points to
+	if op == ctrlutil.OperationResultUpdated || (res.Immutable && op == ctrlutil.OperationResultCreated) {
+		if err := Rollout(ctx, res, Hash(data), c); err != nil {
+			return op, fmt.Errorf("failed to trigger the rollout: %w", err)
+		}
+	}
+	return op, nil
+}
 
-	if !strings.EqualFold(kind, "configmap") {
-		return ctrlutil.OperationResultNone, fmt.Errorf("kind must be Secret or ConfigMap")
+func write(ctx context.Context, res config.ResourceMapping, owner string, data map[string][]byte, c client.Client) (ctrlutil.OperationResult, error) {
+	_, source, _ := strings.Cut(owner, ":")
+	meta, err := newMetadata(ctx, res, source, data, c)
+	if err != nil {
+		return ctrlutil.OperationResultNone, err
+	}
+
+	if res.Immutable {
+		return publish(ctx, res, meta, data, c)
+	}
+	if res.Strategy == StrategyApply {
+		return apply(ctx, res, owner, meta, data, c)
+	}
+
+	obj, err := newObject(res.Name, res.Namespace, res.ResourceType)
+	if err != nil {
+		return ctrlutil.OperationResultNone, err
 	}
 
-	obj := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
 	op, err := ctrlutil.CreateOrUpdate(ctx, c, obj, func() error {
-		obj.Data = data
+		meta.setOn(obj)
+		if res.Strategy == StrategyMerge {
+			return merge(obj, owner, data)
+		}
+		setData(obj, data)
 		return nil
 	})
 	return op, err
 }
 
+// setData replaces all the data in obj
+func setData(obj client.Object, data map[string][]byte) {
+	switch o := obj.(type) {
+	case *corev1.Secret:
+		o.StringData = nil
+		o.Data = data
+	case *corev1.ConfigMap:
+		o.Data, o.BinaryData = splitBinary(data)
+	}
+}
+
+// apply writes data with server-side apply, as the mapping's field manager,
+// the keys previously applied by the same field manager and not in data are removed
+func apply(ctx context.Context, res config.ResourceMapping, owner string, meta metadata, data map[string][]byte, c client.Client) (ctrlutil.OperationResult, error) {
+	obj, err := newObject(res.Name, res.Namespace, res.ResourceType)
+	if err != nil {
+		return ctrlutil.OperationResultNone, err
+	}
+	version := ""
+	if err := c.Get(ctx, client.ObjectKeyFromObject(obj), obj); err == nil {
+		version = obj.GetResourceVersion()
+	} else if !apierrors.IsNotFound(err) {
+		return ctrlutil.OperationResultNone, err
+	}
+
+	var ac runtime.ApplyConfiguration
+	var om *metav1ac.ObjectMetaApplyConfiguration
+	if _, ok := obj.(*corev1.Secret); ok {
+		secret := corev1ac.Secret(res.Name, res.Namespace).WithData(data)
+		ac, om = secret, secret.ObjectMetaApplyConfiguration
+	} else {
+		text, binary := splitBinary(data)
+		cm := corev1ac.ConfigMap(res.Name, res.Namespace).WithData(text).WithBinaryData(binary)
+		ac, om = cm, cm.ObjectMetaApplyConfiguration
+	}
+	meta.applyTo(om)
+
+	manager := fieldManager(res, owner)
+	opts := []client.ApplyOption{client.FieldOwner(manager)}
+	if res.Force {
+		opts = append(opts, client.ForceOwnership)
+	}
+	if err := c.Apply(ctx, ac, opts...); err != nil {
+		if apierrors.IsConflict(err) {
+			return ctrlutil.OperationResultNone, fmt.Errorf("keys managed by another field manager, set force to make %s take ownership: %w", manager, err)
+		}
+		return ctrlutil.OperationResultNone, err
+	}
+
+	switch {
+	case version == "":
+		return ctrlutil.OperationResultCreated, nil
+	case ptr.Deref(om.ResourceVersion, "") != version:
+		return ctrlutil.OperationResultUpdated, nil
+	default:
+		return ctrlutil.OperationResultNone, nil
+	}
+}
+
+// fieldManager returns the mapping's field manager, defaulting to one derived from its owner
+func fieldManager(res config.ResourceMapping, owner string) string {
+	if res.FieldManager != "" {
+		return res.FieldManager
+	}
+	sum := sha256.Sum256([]byte(owner))
+	return DefaultFieldManager + "/" + hex.EncodeToString(sum[:8])
+}
+
+// appliedKeys returns the data keys owned by the given field manager through server-side apply
+func appliedKeys(obj client.Object, manager string) ([]string, error) {
+	var keys []string
+	for _, mf := range obj.GetManagedFields() {
+		if mf.Manager != manager || mf.Operation != metav1.ManagedFieldsOperationApply || mf.FieldsV1 == nil {
+			continue
+		}
+		var fields struct {
+			Data       map[string]any `json:"f:data"`
+			BinaryData map[string]any `json:"f:binaryData"`
+		}
+		if err := json.Unmarshal(mf.FieldsV1.Raw, &fields); err != nil {
+			return nil, fmt.Errorf("invalid managed fields for %s: %w", manager, err)
+		}
+		for f := range fields.Data {
+			if k, ok := strings.CutPrefix(f, "f:"); ok {
+				keys = append(keys, k)
+			}
+		}
+		for f := range fields.BinaryData {
+			if k, ok := strings.CutPrefix(f, "f:"); ok {
+				keys = append(keys, k)
+			}
+		}
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys), nil
+}
+
+// values returns the current value of the given keys in obj
+func values(obj client.Object, keys []string) map[string][]byte {
+	data := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		switch o := obj.(type) {
+		case *corev1.Secret:
+			if v, ok := o.Data[k]; ok {
+				data[k] = v
+			}
+		case *corev1.ConfigMap:
+			if v, ok := o.Data[k]; ok {
+				data[k] = []byte(v)
+			}
+			if v, ok := o.BinaryData[k]; ok {
+				data[k] = v
+			}
+		}
+	}
+	return data
+}
+
+// keysOf returns all the data keys in obj
+func keysOf(obj client.Object) []string {
+	switch o := obj.(type) {
+	case *corev1.Secret:
+		return slices.Collect(maps.Keys(o.Data))
+	case *corev1.ConfigMap:
+		return append(slices.Collect(maps.Keys(o.Data)), slices.Collect(maps.Keys(o.BinaryData))...)
+	}
+	return nil
+}
+
+// splitBinary splits data into the values that are valid UTF-8 and the binary ones
+func splitBinary(data map[string][]byte) (map[string]string, map[string][]byte) {
+	var text map[string]string
+	var binary map[string][]byte
+	for k, v := range data {
+		if utf8.Valid(v) {
+			if text == nil {
+				text = make(map[string]string, len(data))
+			}
+			text[k] = string(v)
+			continue
+		}
+		if binary == nil {
+			binary = make(map[string][]byte)
+		}
+		binary[k] = v
+	}
+	return text, binary
+}
+
+// merge sets the keys in data and removes the ones owner stopped writing,
+// it fails if any of the keys is owned by a different mapping
+func merge(obj client.Object, owner string, data map[string][]byte) error {
+	managed, err := managedKeys(obj)
+	if err != nil {
+		return err
+	}
+	for o, keys := range managed {
+		if o == owner {
+			continue
+		}
+		for _, k := range keys {
+			if _, ok := data[k]; ok {
+				return fmt.Errorf("key %s is already managed by %s", k, o)
+			}
+		}
+	}
+
+	removed := slices.DeleteFunc(slices.Clone(managed[owner]), func(k string) bool {
+		_, ok := data[k]
+		return ok
+	})
+	removeKeys(obj, removed)
+	setKeys(obj, data)
+
+	managed[owner] = slices.Sorted(maps.Keys(data))
+	if len(data) == 0 {
+		delete(managed, owner)
+	}
+	return setManagedKeys(obj, managed)
+}
+
+// managedKeys returns the keys owned by each mapping merging into obj
+func managedKeys(obj client.Object) (map[string][]string, error) {
+	managed := make(map[string][]string)
+	v, ok := obj.GetAnnotations()[ManagedKeysAnnotation]
+	if !ok || v == "" {
+		return managed, nil
+	}
+	if err := json.Unmarshal([]byte(v), &managed); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", ManagedKeysAnnotation, err)
+	}
+	return managed, nil
+}
+
+func setManagedKeys(obj client.Object, managed map[string][]string) error {
+	annotations := obj.GetAnnotations()
+	if len(managed) == 0 {
+		delete(annotations, ManagedKeysAnnotation)
+		obj.SetAnnotations(annotations)
+		return nil
+	}
+
+	v, err := json.Marshal(managed)
+	if err != nil {
+		return err
+	}
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[ManagedKeysAnnotation] = string(v)
+	obj.SetAnnotations(annotations)
+	return nil
+}
+
+func setKeys(obj client.Object, data map[string][]byte) {
+	switch o := obj.(type) {
+	case *corev1.Secret:
+		if o.Data == nil {
+			o.Data = make(map[string][]byte, len(data))
+		}
+		maps.Copy(o.Data, data)
+	case *corev1.ConfigMap:
+		text, binary := splitBinary(data)
+		if len(text) > 0 && o.Data == nil {
+			o.Data = make(map[string]string, len(text))
+		}
+		if len(binary) > 0 && o.BinaryData == nil {
+			o.BinaryData = make(map[string][]byte, len(binary))
+		}
+		// a key moves between data and binaryData when its content changes type
+		for k, v := range text {
+			o.Data[k] = v
+			delete(o.BinaryData, k)
+		}
+		for k, v := range binary {
+			o.BinaryData[k] = v
+			delete(o.Data, k)
+		}
+	}
+}
+
+// removeKeys removes keys from obj and reports whether any of them was set
+func removeKeys(obj client.Object, keys []string) bool {
+	var removed bool
+	for _, k := range keys {
+		switch o := obj.(type) {
+		case *corev1.Secret:
+			if _, ok := o.Data[k]; ok {
+				delete(o.Data, k)
+				removed = true
+			}
+		case *corev1.ConfigMap:
+			if _, ok := o.Data[k]; ok {
+				delete(o.Data, k)
+				removed = true
+			}
+			if _, ok := o.BinaryData[k]; ok {
+				delete(o.BinaryData, k)
+				removed = true
+			}
+		}
+	}
+	return removed
+}
+
+func newObject(name, namespace, kind string) (client.Object, error) {
+	meta := metav1.ObjectMeta{Name: name, Namespace: namespace}
+	switch {
+	case strings.EqualFold(kind, "secret"):
+		return &corev1.Secret{ObjectMeta: meta}, nil
+	case strings.EqualFold(kind, "configmap"):
+		return &corev1.ConfigMap{ObjectMeta: meta}, nil
+	default:
+		return nil, fmt.Errorf("kind must be Secret or ConfigMap")
+	}
+}
+
+// RemoveKeys removes the given keys, written by owner, from an existing Secret or ConfigMap
+func RemoveKeys(ctx context.Context, res config.ResourceMapping, owner string, keys []string, c client.Client) (ctrlutil.OperationResult, error) {
+	obj, err := newObject(res.Name, res.Namespace, res.ResourceType)
+	if err != nil {
+		return ctrlutil.OperationResultNone, err
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+		return ctrlutil.OperationResultNone, client.IgnoreNotFound(err)
+	}
+
+	if res.Immutable {
+		// publish a new revision without the keys
+		current, err := currentRevision(ctx, res, obj, c)
+		if err != nil {
+			return ctrlutil.OperationResultNone, client.IgnoreNotFound(err)
+		}
+		data := values(current, keysOf(current))
+		if !removeKeys(current, keys) {
+			return ctrlutil.OperationResultNone, nil
+		}
+		for _, k := range keys {
+			delete(data, k)
+		}
+		return CreateOrUpdate(ctx, res, owner, data, c)
+	}
+
+	if res.Strategy == StrategyApply {
+		// re-apply the keys still owned by the mapping, the others are released
+		owned, err := appliedKeys(obj, fieldManager(res, owner))
+		if err != nil {
+			return ctrlutil.OperationResultNone, err
+		}
+		owned = slices.DeleteFunc(owned, func(k string) bool {
+			return slices.Contains(keys, k)
+		})
+		data := values(obj, owned)
+		_, source, _ := strings.Cut(owner, ":")
+		meta, err := newMetadata(ctx, res, source, data, c)
+		if err != nil {
+			return ctrlutil.OperationResultNone, err
+		}
+		return apply(ctx, res, owner, meta, data, c)
+	}
+
+	managed, err := managedKeys(obj)
+	if err != nil {
+		return ctrlutil.OperationResultNone, err
+	}
+	if owned, ok := managed[owner]; ok {
+		owned = slices.DeleteFunc(slices.Clone(owned), func(k string) bool {
+			return slices.Contains(keys, k)
+		})
+		managed[owner] = owned
+		if len(owned) == 0 {
+			delete(managed, owner)
+		}
+		if err := setManagedKeys(obj, managed); err != nil {
+			return ctrlutil.OperationResultNone, err
+		}
+	}
+
+	if !removeKeys(obj, keys) {
+		return ctrlutil.OperationResultNone, nil
+	}
+
+	if err := c.Update(ctx, obj); err != nil {
+		return ctrlutil.OperationResultNone, err
+	}
+	return ctrlutil.OperationResultUpdated, nil
+}
+
+// Release removes all the keys owned by owner from a Secret or ConfigMap written with the merge or apply strategy
+func Release(ctx context.Context, res config.ResourceMapping, owner string, c client.Client) (ctrlutil.OperationResult, error) {
+	if res.Strategy == StrategyApply {
+		// applying no data releases all the keys and metadata owned by the field manager
+		return apply(ctx, res, owner, metadata{}, nil, c)
+	}
+	return removeOwners(ctx, res, c, func(o string) bool {
+		return o == owner
+	})
+}
+
+// Prune removes, from the resources written with the merge strategy, the keys owned by the mappings
+// whose owner starts with prefix but is no longer in mappings, mappings is indexed by owner
+func Prune(ctx context.Context, prefix string, mappings map[string]config.ResourceMapping, c client.Client) error {
+	resources := make(map[string]config.ResourceMapping)
+	owners := make(map[string][]string)
+	for owner, res := range mappings {
+		if res.Strategy != StrategyMerge || res.Name == "" {
+			continue
+		}
+		id := fmt.Sprintf("%s: %s/%s", strings.ToLower(res.ResourceType), res.Namespace, res.Name)
+		resources[id] = res
+		owners[id] = append(owners[id], owner)
+	}
+
+	var errs []error
+	for id, res := range resources {
+		_, err := removeOwners(ctx, res, c, func(o string) bool {
+			return strings.HasPrefix(o, prefix) && !slices.Contains(owners[id], o)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func removeOwners(ctx context.Context, res config.ResourceMapping, c client.Client, match func(string) bool) (ctrlutil.OperationResult, error) {
+	obj, err := newObject(res.Name, res.Namespace, res.ResourceType)
+	if err != nil {
+		return ctrlutil.OperationResultNone, err
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+		return ctrlutil.OperationResultNone, client.IgnoreNotFound(err)
+	}
+
+	managed, err := managedKeys(obj)
+	if err != nil {
+		return ctrlutil.OperationResultNone, err
+	}
+	var found bool
+	for o, keys := range managed {
+		if !match(o) {
+			continue
+		}
+		removeKeys(obj, keys)
+		delete(managed, o)
+		found = true
+	}
+	if !found {
+		return ctrlutil.OperationResultNone, nil
+	}
+	if err := setManagedKeys(obj, managed); err != nil {
+		return ctrlutil.OperationResultNone, err
+	}
+
+	if err := c.Update(ctx, obj); err != nil {
+		return ctrlutil.OperationResultNone, err
+	}
+	return ctrlutil.OperationResultUpdated, nil
+}
+
+// Delete deletes a Secret or ConfigMap, and all its revisions, it's not an error if it doesn't exist
+func Delete(ctx context.Context, res config.ResourceMapping, c client.Client) error {
+	obj, err := newObject(res.Name, res.Namespace, res.ResourceType)
+	if err != nil {
+		return err
+	}
+	if res.Immutable {
+		revision, _ := newObject("", res.Namespace, res.ResourceType)
+		if err := c.DeleteAllOf(ctx, revision, client.InNamespace(res.Namespace), client.MatchingLabels{RevisionOfLabel: res.Name}); err != nil {
+			return err
+		}
+	}
+	return client.IgnoreNotFound(c.Delete(ctx, obj))
+}
+
 func findProcess(ctx context.Context, process string) (*ps.Process, error) {
 	processes, err := ps.ProcessesWithContext(ctx)
 	if err != nil {
@@ -137,3 +650,41 @@ func ReadersEqual(r1, r2 io.Reader, chunkSize int) (bool, error) {
 		}
 	}
 }
+
+// Hash returns a digest of data that changes when any of its keys or values change
+func Hash[V string | []byte](data map[string]V) string {
+	h := sha256.New()
+	for _, k := range slices.Sorted(maps.Keys(data)) {
+		// prefix with the lengths so different maps can't produce the same input
+		_, _ = fmt.Fprintf(h, "%d:%s%d:%s", len(k), k, len(data[k]), data[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ReadValue reads the value from the file or the Secret key in v, without surrounding whitespace,
+// namespace is used when the Secret reference doesn't set it
+func ReadValue(ctx context.Context, v config.ValueFrom, namespace string, c client.Client) ([]byte, error) {
+	if v.File != "" {
+		b, err := os.ReadFile(v.File)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimSpace(b), nil
+	}
+
+	if v.Secret.Name == "" {
+		return nil, nil
+	}
+	if v.Secret.Namespace != "" {
+		namespace = v.Secret.Namespace
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, client.ObjectKey{Name: v.Secret.Name, Namespace: namespace}, secret); err != nil {
+		return nil, err
+	}
+	b, ok := secret.Data[v.Secret.Key]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found in Secret %s/%s", v.Secret.Key, namespace, v.Secret.Name)
+	}
+	return bytes.TrimSpace(b), nil
+}
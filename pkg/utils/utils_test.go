@@ -1,8 +1,19 @@
 package utils
 
 import (
+	"bytes"
+	"context"
+	"maps"
 	"strings"
 	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	ctrlutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/luisdavim/configmapper/pkg/config"
 )
 
 func TestReadersEqual(t *testing.T) {
@@ -59,3 +70,209 @@ func TestReadersEqual(t *testing.T) {
 		})
 	}
 }
+
+func TestHash(t *testing.T) {
+	t.Parallel()
+
+	a := Hash(map[string]string{"a": "1", "b": "2"})
+	if b := Hash(map[string]string{"b": "2", "a": "1"}); a != b {
+		t.Fatalf("Hash() = %s and %s for the same data", a, b)
+	}
+	if b := Hash(map[string]string{"a": "12", "b": ""}); a == b {
+		t.Fatalf("Hash() = %s for different data", a)
+	}
+	if b := Hash(map[string]string{"a": "1:b2"}); a == b {
+		t.Fatalf("Hash() = %s for different data", a)
+	}
+}
+
+func TestCreateOrUpdateMerge(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	res := config.ResourceMapping{ResourceType: "configmap", Namespace: "default", Name: "app", Strategy: StrategyMerge}
+	c := fake.NewClientBuilder().WithObjects(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Data:       map[string]string{"manual": "x"},
+	}).Build()
+
+	get := func() *corev1.ConfigMap {
+		t.Helper()
+		cm := &corev1.ConfigMap{}
+		if err := c.Get(ctx, client.ObjectKey{Name: "app", Namespace: "default"}, cm); err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		return cm
+	}
+
+	if _, err := CreateOrUpdate(ctx, res, "file:/a", map[string][]byte{"a": []byte("1"), "old": []byte("1")}, c); err != nil {
+		t.Fatalf("CreateOrUpdate() error = %v", err)
+	}
+	if _, err := CreateOrUpdate(ctx, res, "url:b", map[string][]byte{"b": []byte("2")}, c); err != nil {
+		t.Fatalf("CreateOrUpdate() error = %v", err)
+	}
+	if _, err := CreateOrUpdate(ctx, res, "file:/a", map[string][]byte{"a": []byte("3")}, c); err != nil {
+		t.Fatalf("CreateOrUpdate() error = %v", err)
+	}
+	if _, err := CreateOrUpdate(ctx, res, "url:b", map[string][]byte{"a": []byte("4")}, c); err == nil {
+		t.Fatalf("CreateOrUpdate() expected an error writing a key owned by another mapping")
+	}
+
+	want := map[string]string{"manual": "x", "a": "3", "b": "2"}
+	if cm := get(); !maps.Equal(cm.Data, want) {
+		t.Fatalf("Data = %v, want %v", cm.Data, want)
+	}
+
+	// file:/a is no longer configured
+	if err := Prune(ctx, "file:", map[string]config.ResourceMapping{"file:/c": res}, c); err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	cm := get()
+	want = map[string]string{"manual": "x", "b": "2"}
+	if !maps.Equal(cm.Data, want) {
+		t.Fatalf("Data = %v, want %v", cm.Data, want)
+	}
+	if got, want := cm.Annotations[ManagedKeysAnnotation], `{"url:b":["b"]}`; got != want {
+		t.Fatalf("%s = %s, want %s", ManagedKeysAnnotation, got, want)
+	}
+
+	if _, err := Release(ctx, res, "url:b", c); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	cm = get()
+	want = map[string]string{"manual": "x"}
+	if !maps.Equal(cm.Data, want) {
+		t.Fatalf("Data = %v, want %v", cm.Data, want)
+	}
+	if _, ok := cm.Annotations[ManagedKeysAnnotation]; ok {
+		t.Fatalf("%s annotation should be removed once no keys are managed", ManagedKeysAnnotation)
+	}
+}
+
+func TestCreateOrUpdateApply(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	res := config.ResourceMapping{ResourceType: "configmap", Namespace: "default", Name: "app", Strategy: StrategyApply}
+	c := fake.NewClientBuilder().WithReturnManagedFields().Build()
+
+	get := func() *corev1.ConfigMap {
+		t.Helper()
+		cm := &corev1.ConfigMap{}
+		if err := c.Get(ctx, client.ObjectKey{Name: "app", Namespace: "default"}, cm); err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		return cm
+	}
+
+	op, err := CreateOrUpdate(ctx, res, "file:/a", map[string][]byte{"a": []byte("1"), "b": []byte("1")}, c)
+	if err != nil {
+		t.Fatalf("CreateOrUpdate() error = %v", err)
+	}
+	if op != ctrlutil.OperationResultCreated {
+		t.Fatalf("CreateOrUpdate() = %s, want %s", op, ctrlutil.OperationResultCreated)
+	}
+
+	// mappings without a field manager get their own, so they don't release each other's keys
+	if _, err := CreateOrUpdate(ctx, res, "file:/d", map[string][]byte{"d": []byte("1")}, c); err != nil {
+		t.Fatalf("CreateOrUpdate() error = %v", err)
+	}
+	if _, err := CreateOrUpdate(ctx, res, "file:/a", map[string][]byte{"a": []byte("1"), "b": []byte("1")}, c); err != nil {
+		t.Fatalf("CreateOrUpdate() error = %v", err)
+	}
+	want := map[string]string{"a": "1", "b": "1", "d": "1"}
+	if cm := get(); !maps.Equal(cm.Data, want) {
+		t.Fatalf("Data = %v, want %v", cm.Data, want)
+	}
+	if _, err := Release(ctx, res, "file:/d", c); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+
+	other := res
+	other.FieldManager = "other"
+	if _, err := CreateOrUpdate(ctx, other, "url:c", map[string][]byte{"c": []byte("2")}, c); err != nil {
+		t.Fatalf("CreateOrUpdate() error = %v", err)
+	}
+	if _, err := CreateOrUpdate(ctx, other, "url:c", map[string][]byte{"a": []byte("2"), "c": []byte("2")}, c); err == nil {
+		t.Fatalf("CreateOrUpdate() expected a conflict writing a key owned by another field manager")
+	}
+
+	// keys no longer applied by the field manager are removed
+	if _, err := CreateOrUpdate(ctx, res, "file:/a", map[string][]byte{"a": []byte("3")}, c); err != nil {
+		t.Fatalf("CreateOrUpdate() error = %v", err)
+	}
+	want = map[string]string{"a": "3", "c": "2"}
+	if cm := get(); !maps.Equal(cm.Data, want) {
+		t.Fatalf("Data = %v, want %v", cm.Data, want)
+	}
+
+	other.Force = true
+	if _, err := CreateOrUpdate(ctx, other, "url:c", map[string][]byte{"a": []byte("4"), "c": []byte("2")}, c); err != nil {
+		t.Fatalf("CreateOrUpdate() with force error = %v", err)
+	}
+	if _, err := RemoveKeys(ctx, other, "url:c", []string{"a"}, c); err != nil {
+		t.Fatalf("RemoveKeys() error = %v", err)
+	}
+	want = map[string]string{"c": "2"}
+	if cm := get(); !maps.Equal(cm.Data, want) {
+		t.Fatalf("Data = %v, want %v", cm.Data, want)
+	}
+}
+
+func TestCreateOrUpdateBinary(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	c := fake.NewClientBuilder().Build()
+	blob := []byte{0x1f, 0x8b, 0x08, 0x00, 0xff}
+
+	for _, strategy := range []string{StrategyReplace, StrategyMerge} {
+		res := config.ResourceMapping{ResourceType: "configmap", Namespace: "default", Name: strategy, Strategy: strategy}
+		if _, err := CreateOrUpdate(ctx, res, "file:/a", map[string][]byte{"text": []byte("a: b"), "blob": blob}, c); err != nil {
+			t.Fatalf("CreateOrUpdate() error = %v", err)
+		}
+		// the key moves to data once its content is valid UTF-8
+		if _, err := CreateOrUpdate(ctx, res, "file:/a", map[string][]byte{"text": blob, "blob": []byte("c: d")}, c); err != nil {
+			t.Fatalf("CreateOrUpdate() error = %v", err)
+		}
+
+		cm := &corev1.ConfigMap{}
+		if err := c.Get(ctx, client.ObjectKey{Name: strategy, Namespace: "default"}, cm); err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if want := map[string]string{"blob": "c: d"}; !maps.Equal(cm.Data, want) {
+			t.Errorf("%s: Data = %v, want %v", strategy, cm.Data, want)
+		}
+		if len(cm.BinaryData) != 1 || !bytes.Equal(cm.BinaryData["text"], blob) {
+			t.Errorf("%s: BinaryData = %v, want text: %v", strategy, cm.BinaryData, blob)
+		}
+	}
+
+	res := config.ResourceMapping{ResourceType: "secret", Namespace: "default", Name: "secret"}
+	if _, err := CreateOrUpdate(ctx, res, "file:/a", map[string][]byte{"keystore": blob}, c); err != nil {
+		t.Fatalf("CreateOrUpdate() error = %v", err)
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, client.ObjectKey{Name: "secret", Namespace: "default"}, secret); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !bytes.Equal(secret.Data["keystore"], blob) {
+		t.Errorf("Secret Data = %v, want keystore: %v", secret.Data, blob)
+	}
+}
+
+func TestEncodeKey(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"config.yaml":         "config.yaml",
+		"conf.d/app.conf":     "conf.d__app.conf",
+		"a/b/with space.yaml": "a__b__with-space.yaml",
+	}
+
+	for rel, want := range tests {
+		if got := EncodeKey(rel); got != want {
+			t.Errorf("EncodeKey(%q) = %q, want %q", rel, got, want)
+		}
+	}
+}